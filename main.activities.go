@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hornbill/pb"
+	"github.com/hornbill/sqlx"
+)
+
+//----- Activity Definition Structs
+type activitiesConfStruct struct {
+	Concurrent  bool
+	Definitions []snActivityConfStruct
+}
+
+//UnmarshalJSON - reads ConfActivities as an object holding a list of Definitions, as a plain list of definitions,
+//or as the single activity definition supported by previous versions of the import
+func (activitiesConf *activitiesConfStruct) UnmarshalJSON(data []byte) error {
+	trimmedData := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmedData, []byte("[")) {
+		return json.Unmarshal(trimmedData, &activitiesConf.Definitions)
+	}
+	var confKeys map[string]json.RawMessage
+	if err := json.Unmarshal(trimmedData, &confKeys); err != nil {
+		return err
+	}
+	if _, ok := confKeys["Definitions"]; ok {
+		type activitiesConfAlias activitiesConfStruct
+		return json.Unmarshal(trimmedData, (*activitiesConfAlias)(activitiesConf))
+	}
+	var activityConf snActivityConfStruct
+	if err := json.Unmarshal(trimmedData, &activityConf); err != nil {
+		return err
+	}
+	activitiesConf.Definitions = []snActivityConfStruct{activityConf}
+	return nil
+}
+
+//processActivityDefinitions - imports the activities of each enabled activity definition, one after another or concurrently.
+//Concurrent definitions are queried first, then imported under a single progress bar, sharing the concurrent request limit
+func processActivityDefinitions() {
+	if !snImportConf.ConfActivities.Concurrent {
+		for _, activityConf := range snImportConf.ConfActivities.Definitions {
+			if activityConf.Import {
+				processActivities(activityConf)
+			}
+		}
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	var activityConfs []snActivityConfStruct
+	var activityRecords [][]map[string]interface{}
+	intActivities := 0
+	for _, activityConf := range snImportConf.ConfActivities.Definitions {
+		if !activityConf.Import {
+			continue
+		}
+		activityName := getActivityDefinitionName(activityConf)
+		logger(1, "Processing Activities ["+activityName+"], please wait...", true)
+		arrActivityDetailsMaps, boolQueryOk := queryDBActivityDetails(activityConf, connStrAppDB)
+		if !boolQueryOk {
+			logger(4, "Request Search Failed for Request Activities ["+activityName+"].", true)
+			continue
+		}
+		activityConfs = append(activityConfs, activityConf)
+		activityRecords = append(activityRecords, arrActivityDetailsMaps)
+		intActivities += len(arrActivityDetailsMaps)
+	}
+	if len(activityConfs) == 0 {
+		return
+	}
+	var wgDefinitions, wgActivity sync.WaitGroup
+	bar := pb.StartNew(intActivities)
+	maxGoroutinesGuard := make(chan struct{}, maxGoroutines)
+	for i := range activityConfs {
+		wgDefinitions.Add(1)
+		go func(arrActivityDetailsMaps []map[string]interface{}, activityConf snActivityConfStruct) {
+			defer wgDefinitions.Done()
+			addActivities(arrActivityDetailsMaps, activityConf, bar, maxGoroutinesGuard, &wgActivity)
+		}(activityRecords[i], activityConfs[i])
+	}
+	wgDefinitions.Wait()
+	wgActivity.Wait()
+	bar.FinishPrint("Request Activity Import Complete")
+}
+
+//getActivityDefinitionName - returns the name of an activity definition for logging, defaulting to its category
+func getActivityDefinitionName(activityConf snActivityConfStruct) string {
+	if activityConf.Name != "" {
+		return activityConf.Name
+	}
+	if activityConf.Category != "" {
+		return activityConf.Category
+	}
+	return "Activities"
+}
+
+//queryDBActivityDetails - runs the SQLStatement of an activity definition, and returns the records to import as activities
+func queryDBActivityDetails(activityConf snActivityConfStruct, connString string) ([]map[string]interface{}, bool) {
+	var arrActivityDetailsMaps []map[string]interface{}
+	activityName := getActivityDefinitionName(activityConf)
+	db, err := sqlx.Open(appDBDriver, connString)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Activities ["+activityName+"]: "+err.Error(), true)
+		return arrActivityDetailsMaps, false
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Activities ["+activityName+"]: "+err.Error(), true)
+		return arrActivityDetailsMaps, false
+	}
+	logger(3, "[DATABASE] Running query for Activities ["+activityName+"]. Please wait...", false)
+
+	strSQLQuery := ""
+	arrQueryLen := len(activityConf.SQLStatement)
+	for i := 0; i < arrQueryLen; i++ {
+		strSQLQuery += " " + fmt.Sprintf("%s", activityConf.SQLStatement[strconv.Itoa(i)])
+	}
+	if configDebug {
+		logger(1, "[DATABASE] Query to retrieve Activities ["+activityName+"] from ServiceNow data: "+strSQLQuery, false)
+	}
+	rows, err := db.Queryx(strSQLQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Activities ["+activityName+"]: "+err.Error(), true)
+		return arrActivityDetailsMaps, false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		results := make(map[string]interface{})
+		_ = rows.MapScan(results)
+		arrActivityDetailsMaps = append(arrActivityDetailsMaps, results)
+	}
+	return arrActivityDetailsMaps, true
+}
+
+//getActivityAction - maps a ServiceNow activity status through the activity StatusMapping, to complete, cancel or open.
+//Statuses not in the StatusMapping default to complete for Closed Complete and Closed Incomplete, cancel for Cancelled and
+//Closed Skipped, and open for all others
+func getActivityAction(snStatus string, activityConf snActivityConfStruct) string {
+	if activityConf.StatusMapping[snStatus] != nil {
+		return strings.ToLower(fmt.Sprintf("%v", activityConf.StatusMapping[snStatus]))
+	}
+	switch snStatus {
+	case "Closed Complete", "Closed Incomplete":
+		return "complete"
+	case "Cancelled", "Closed Skipped":
+		return "cancel"
+	}
+	return "open"
+}
+
+//getOutcomeMapping - returns the ServiceNow decision to Hornbill outcome mapping for an activity category.
+//Without an OutcomeMapping, BPM Authorisation activities map approved and rejected to accept and refuse
+func getOutcomeMapping(strCategory string, activityConf snActivityConfStruct) map[string]string {
+	outcomeMapping := make(map[string]string)
+	if len(activityConf.OutcomeMapping) > 0 {
+		for snDecision, smOutcome := range activityConf.OutcomeMapping {
+			outcomeMapping[strings.ToLower(snDecision)] = fmt.Sprintf("%v", smOutcome)
+		}
+		return outcomeMapping
+	}
+	if strCategory == "BPM Authorisation" {
+		outcomeMapping["approved"] = "accept"
+		outcomeMapping["rejected"] = "refuse"
+	}
+	return outcomeMapping
+}
+
+//getActivityOutcomes - returns the outcomes to define against a new activity, from the values of its outcome mapping
+func getActivityOutcomes(strCategory string, activityConf snActivityConfStruct) []string {
+	var activityOutcomes []string
+	outcomesAdded := make(map[string]bool)
+	for _, smOutcome := range getOutcomeMapping(strCategory, activityConf) {
+		if smOutcome == "" || outcomesAdded[smOutcome] {
+			continue
+		}
+		outcomesAdded[smOutcome] = true
+		activityOutcomes = append(activityOutcomes, smOutcome)
+	}
+	if len(activityOutcomes) == 0 {
+		return []string{"done"}
+	}
+	sort.Strings(activityOutcomes)
+	return activityOutcomes
+}
+
+//getOutcomeDisplayName - returns the button text of an activity outcome
+func getOutcomeDisplayName(strOutcome string) string {
+	switch strOutcome {
+	case "accept":
+		return "Authorise"
+	case "refuse":
+		return "Rejected"
+	case "done":
+		return "Done"
+	}
+	return strOutcome
+}
+
+//getActivityOutcome - returns the outcome to complete an activity with, from its ServiceNow decision.
+//Activities with a single outcome always complete with it, otherwise an unmapped decision returns an empty outcome
+func getActivityOutcome(strDecision, strCategory string, activityOutcomes []string, activityConf snActivityConfStruct) string {
+	if smOutcome, ok := getOutcomeMapping(strCategory, activityConf)[strings.ToLower(strDecision)]; ok && smOutcome != "" {
+		return smOutcome
+	}
+	if len(activityOutcomes) == 1 {
+		return activityOutcomes[0]
+	}
+	return ""
+}
+
+//completeActivity - completes an activity with the given outcome and reason
+func completeActivity(taskID, strOutcome, strReason string) bool {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return false
+	}
+	//Refused outcomes require a reason, which rejections in ServiceNow are often made without
+	if strReason == "" && strOutcome == "refuse" {
+		strReason = "Rejected in ServiceNow"
+	}
+	espXmlmc.SetParam("taskId", taskID)
+	espXmlmc.SetParam("outcome", strOutcome)
+	if strReason != "" {
+		espXmlmc.SetParam("reason", strReason)
+	}
+	XMLComplete, xmlmcErr := espXmlmc.Invoke("task", "taskComplete")
+	if xmlmcErr != nil {
+		logger(4, "Unable to complete activity on Hornbill instance: "+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLComplete), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read complete activity response on Hornbill instance:"+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to complete activity: "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
+
+//cancelActivity - cancels an activity, with the ServiceNow reason where one exists
+func cancelActivity(taskID, strReason string) bool {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return false
+	}
+	espXmlmc.SetParam("taskId", taskID)
+	if strReason != "" {
+		espXmlmc.SetParam("reason", strReason)
+	}
+	XMLCancel, xmlmcErr := espXmlmc.Invoke("task", "taskCancel")
+	if xmlmcErr != nil {
+		logger(4, "Unable to cancel activity on Hornbill instance: "+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLCancel), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read cancel activity response on Hornbill instance:"+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to cancel activity: "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
+
+//getActivityUserID - returns the Hornbill user ID of a ServiceNow user, matched against the analysts and then the customers
+func getActivityUserID(snUser string) string {
+	if snUser == "" {
+		return ""
+	}
+	boolUserExists, _, strUserID := recordInCache(snUser, "Analyst")
+	if boolUserExists {
+		return strUserID
+	}
+	if doesAuthorCustomerExist(snUser) {
+		return snUser
+	}
+	if configDebug {
+		logger(1, "Activity user ["+snUser+"] could not be resolved to a Hornbill user", false)
+	}
+	return ""
+}
+
+//updateActivityRecord - updates columns of an activity record, for values the task API does not accept
+func updateActivityRecord(taskID string, taskColumns map[string]string) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", "com.hornbill.core")
+	espXmlmc.SetParam("entity", "Task")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_task_id", taskID)
+	for taskColumn, columnValue := range taskColumns {
+		espXmlmc.SetParam(taskColumn, columnValue)
+	}
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to update activity ["+taskID+"]: "+xmlmcErr.Error(), false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to update activity ["+taskID+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to update activity ["+taskID+"]: "+xmlRespon.State.ErrorRet, false)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Asset Link Structs
+type assetLinkConfStruct struct {
+	Import       bool
+	TaskCI       bool
+	MatchOn      []string
+	NameColumn   string
+	SerialColumn string
+	AssetMapping map[string]interface{}
+}
+
+type taskCIStruct struct {
+	SysID        string `db:"ci_sys_id"`
+	Name         string `db:"ci_name"`
+	SerialNumber string `db:"ci_serial_number"`
+	Source       string `db:"ci_source"`
+}
+
+type xmlmcAssetSearchResponse struct {
+	MethodResult string      `xml:"status,attr"`
+	AssetID      string      `xml:"params>rowData>row>h_pk_asset_id"`
+	State        stateStruct `xml:"state"`
+}
+
+var (
+	assetCache      = make(map[string]string)
+	mutexAssetCache = &sync.Mutex{}
+)
+
+//processTaskCIs - links an imported request to the Hornbill assets matching the affected CIs of its ServiceNow task,
+//and reports the CIs that could not be matched
+func processTaskCIs(smCallRef, snCallRef, snTaskSysID string) {
+	for _, taskCI := range getTaskCIs(snTaskSysID) {
+		assetID := getAssetID(taskCI)
+		if assetID == "" {
+			logger(5, "CI ["+taskCI.Name+"] of ["+snCallRef+"] could not be matched to a Hornbill asset", false)
+			writeReportRow("SN_Unmatched_CIs", []string{"ServiceNow Task", "Hornbill Request", "CI Sys ID", "CI Name", "CI Serial Number", "CI Source"},
+				[]string{snCallRef, smCallRef, taskCI.SysID, taskCI.Name, taskCI.SerialNumber, taskCI.Source})
+			continue
+		}
+		addAssetLink(assetID, smCallRef)
+	}
+}
+
+//getTaskCIs - returns the CI of a ServiceNow task, and its task_ci affected CIs where configured, without duplicates
+func getTaskCIs(snTaskSysID string) []taskCIStruct {
+	var taskCIs []taskCIStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Task CIs: "+err.Error(), false)
+		return taskCIs
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Task CIs: "+err.Error(), false)
+		return taskCIs
+	}
+	sqlCIQuery := "SELECT cmdb_ci.sys_id AS ci_sys_id, COALESCE(cmdb_ci.name, '') AS ci_name, COALESCE(cmdb_ci.serial_number, '') AS ci_serial_number, 'cmdb_ci' AS ci_source "
+	sqlCIQuery += " FROM task JOIN cmdb_ci ON task.cmdb_ci = cmdb_ci.sys_id "
+	sqlCIQuery += " WHERE task.sys_id = '" + snTaskSysID + "'"
+	if mapGenericConf.AssetLinks.TaskCI {
+		sqlCIQuery += " UNION SELECT cmdb_ci.sys_id AS ci_sys_id, COALESCE(cmdb_ci.name, '') AS ci_name, COALESCE(cmdb_ci.serial_number, '') AS ci_serial_number, 'task_ci' AS ci_source "
+		sqlCIQuery += " FROM task_ci JOIN cmdb_ci ON task_ci.ci_item = cmdb_ci.sys_id "
+		sqlCIQuery += " WHERE task_ci.task = '" + snTaskSysID + "'"
+	}
+	if configDebug {
+		logger(1, "[DATABASE] Task CI Query: "+sqlCIQuery, false)
+	}
+	var ciRows []taskCIStruct
+	err = db.Select(&ciRows, sqlCIQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Task CIs: "+err.Error(), false)
+		return taskCIs
+	}
+	ciAdded := make(map[string]bool)
+	for _, ciRow := range ciRows {
+		if ciAdded[ciRow.SysID] {
+			continue
+		}
+		ciAdded[ciRow.SysID] = true
+		taskCIs = append(taskCIs, ciRow)
+	}
+	return taskCIs
+}
+
+//getAssetID - matches a ServiceNow CI to a Hornbill asset, trying each MatchOn strategy of the class in order.
+//Defaults to matching on the asset name
+func getAssetID(taskCI taskCIStruct) string {
+	matchOn := mapGenericConf.AssetLinks.MatchOn
+	if len(matchOn) == 0 {
+		matchOn = []string{"name"}
+	}
+	for _, matchStrategy := range matchOn {
+		assetID := ""
+		switch strings.ToLower(matchStrategy) {
+		case "mapping":
+			if mapGenericConf.AssetLinks.AssetMapping[taskCI.Name] != nil {
+				assetID = fmt.Sprintf("%v", mapGenericConf.AssetLinks.AssetMapping[taskCI.Name])
+			}
+		case "name":
+			nameColumn := mapGenericConf.AssetLinks.NameColumn
+			if nameColumn == "" {
+				nameColumn = "h_name"
+			}
+			assetID = getCachedAssetID(nameColumn, taskCI.Name)
+		case "serial":
+			serialColumn := mapGenericConf.AssetLinks.SerialColumn
+			if serialColumn == "" {
+				serialColumn = "h_serial_number"
+			}
+			assetID = getCachedAssetID(serialColumn, taskCI.SerialNumber)
+		default:
+			logger(5, "Asset MatchOn strategy ["+matchStrategy+"] is not supported", false)
+		}
+		if assetID != "" {
+			return assetID
+		}
+	}
+	return ""
+}
+
+//getCachedAssetID - returns the ID of the Hornbill asset with the given column value, from the cache or the instance
+func getCachedAssetID(assetColumn, assetValue string) string {
+	if assetValue == "" {
+		return ""
+	}
+	cacheKey := assetColumn + "|" + assetValue
+	mutexAssetCache.Lock()
+	assetID, ok := assetCache[cacheKey]
+	mutexAssetCache.Unlock()
+	if ok {
+		return assetID
+	}
+	assetID = searchAsset(assetColumn, assetValue)
+	mutexAssetCache.Lock()
+	assetCache[cacheKey] = assetID
+	mutexAssetCache.Unlock()
+	return assetID
+}
+
+//searchAsset - searches Hornbill for an asset with the given column value
+func searchAsset(assetColumn, assetValue string) string {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return ""
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Asset")
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", assetColumn)
+	espXmlmc.SetParam("value", assetValue)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", "1")
+
+	XMLAssetSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		logger(4, "Unable to Search for Asset ["+assetValue+"]: "+xmlmcErr.Error(), false)
+		return ""
+	}
+	var xmlRespon xmlmcAssetSearchResponse
+	err = xml.Unmarshal([]byte(XMLAssetSearch), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to Search for Asset ["+assetValue+"]: "+err.Error(), false)
+		return ""
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to Search for Asset ["+assetValue+"]: "+xmlRespon.State.ErrorRet, false)
+		return ""
+	}
+	return xmlRespon.AssetID
+}
+
+//addAssetLink - links a Hornbill asset to an imported request
+func addAssetLink(assetID, smCallRef string) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "AssetsLinks")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_fk_id_l", "urn:sys:entity:"+appServiceManager+":Asset:"+assetID)
+	espXmlmc.SetParam("h_fk_id_r", "urn:sys:entity:"+appServiceManager+":Requests:"+smCallRef)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLLink, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to link Asset ["+assetID+"] to ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLLink), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to link Asset ["+assetID+"] to ["+smCallRef+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to link Asset ["+assetID+"] to ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+		return
+	}
+	if configDebug {
+		logger(1, "Asset ["+assetID+"] linked to ["+smCallRef+"]", false)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//----- Attachment Export Structs
+type attachmentExportStruct struct {
+	file      *os.File
+	hash      hash.Hash
+	filePath  string
+	committed bool
+	err       error
+}
+
+//getAttachmentSink - returns where attachments are written to: hornbill (default), disk or both
+func getAttachmentSink() string {
+	strSink := strings.ToLower(snImportConf.Attachments.Sink)
+	if strSink != "disk" && strSink != "both" {
+		return "hornbill"
+	}
+	return strSink
+}
+
+//createAttachmentExport - creates the file an attachment is exported to, as <OutputFolder>/<request key>/<file name>, where the request
+//key is the ServiceNow ref, prefixed with KE: for Known Errors so a flagged Problem and its Known Error export to folders of their own.
+//The content is written to a .part file, which is only renamed to the file name once the whole attachment has been written and verified
+func createAttachmentExport(requestKey string, fileRecord fileAssocStruct) (*attachmentExportStruct, error) {
+	outputFolder := snImportConf.Attachments.OutputFolder
+	if outputFolder == "" {
+		cwd, _ := os.Getwd()
+		outputFolder = filepath.Join(cwd, "attachments")
+	}
+	exportFolder := filepath.Join(outputFolder, getAttachmentFileName(requestKey))
+	err := os.MkdirAll(exportFolder, 0777)
+	if err != nil {
+		return nil, err
+	}
+	//Tasks can hold more than one attachment with the same name, so where the file name is already taken on disk, by this or an earlier
+	//run, the attachment has its sys_id added. The file name is reserved with an empty file, which the .part file replaces on commit
+	filePath := filepath.Join(exportFolder, getAttachmentFileName(fileRecord.FileName))
+	err = reserveAttachmentExport(filePath)
+	if os.IsExist(err) {
+		fileExt := filepath.Ext(filePath)
+		filePath = strings.TrimSuffix(filePath, fileExt) + "_" + fileRecord.FileGUID + fileExt
+		err = reserveAttachmentExport(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	exportFile, err := os.Create(filePath + ".part")
+	if err != nil {
+		os.Remove(filePath)
+		return nil, err
+	}
+	return &attachmentExportStruct{file: exportFile, hash: sha256.New(), filePath: filePath}, nil
+}
+
+//reserveAttachmentExport - creates an empty file at the export path, failing with an error where the file already exists
+func reserveAttachmentExport(filePath string) error {
+	reservedFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	return reservedFile.Close()
+}
+
+//Write - writes the attachment content to the export file, and adds it to the file checksum
+func (attachmentExport *attachmentExportStruct) Write(p []byte) (int, error) {
+	n, err := attachmentExport.file.Write(p)
+	if err != nil {
+		attachmentExport.err = err
+		return n, err
+	}
+	attachmentExport.hash.Write(p[:n])
+	return n, nil
+}
+
+//commit - completes the export of an attachment, renaming the .part file to the file name, and records the file in the export manifest
+func (attachmentExport *attachmentExportStruct) commit(snCallRef string, fileRecord fileAssocStruct, fileSize int64) error {
+	err := attachmentExport.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(attachmentExport.filePath+".part", attachmentExport.filePath)
+	if err != nil {
+		return err
+	}
+	attachmentExport.committed = true
+	manifestFolder := filepath.Dir(filepath.Dir(attachmentExport.filePath))
+	appendCSVRow(filepath.Join(manifestFolder, "manifest_"+timeNow+".csv"),
+		[]string{"ServiceNow Task", "Hornbill Request", "Attachment Sys ID", "File Name", "Content Type", "Size Bytes", "SHA256", "Added By", "Added On", "Path"},
+		[]string{snCallRef, fileRecord.SMCallRef, fileRecord.FileGUID, fileRecord.FileName, fileRecord.ContentType, strconv.FormatInt(fileSize, 10),
+			hex.EncodeToString(attachmentExport.hash.Sum(nil)), fileRecord.AddedBy, fileRecord.TimeAdded, attachmentExport.filePath})
+	counters.Lock()
+	counters.filesExported++
+	counters.Unlock()
+	return nil
+}
+
+//abort - removes the .part file and the reserved file name of an attachment export that was not completed
+func (attachmentExport *attachmentExportStruct) abort() {
+	if attachmentExport.committed {
+		return
+	}
+	attachmentExport.file.Close()
+	os.Remove(attachmentExport.filePath + ".part")
+	os.Remove(attachmentExport.filePath)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//----- Attachment Structs
+type attachmentsConfStruct struct {
+	MaxSizeBytes        float64
+	IncludeContentTypes []string
+	ExcludeContentTypes []string
+	IncludeExtensions   []string
+	ExcludeExtensions   []string
+	VerifySize          bool
+	Sink                string
+	OutputFolder        string
+	Source              attachmentSourceConfStruct
+}
+
+//attachmentStream - counts the bytes read from the decompressed file content, and keeps the first error reading it
+type attachmentStream struct {
+	reader io.Reader
+	size   int64
+	err    error
+}
+
+//davClient - the client for the Hornbill instance DAV endpoint and the S3 attachment source. No overall timeout is set, as uploads
+//and downloads of large files can take longer than the XMLMC timeout, but connections that stall while connecting, before returning
+//a response, or while idle are timed out, so a stalled connection cannot block an attachment worker indefinitely
+var davClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   30 * time.Second,
+	ResponseHeaderTimeout: 5 * time.Minute,
+	IdleConnTimeout:       90 * time.Second,
+}}
+
+//Attachment outcomes, as recorded in the attachment report
+const (
+	attachmentAttached        = "attached"
+	attachmentExported        = "exported"
+	attachmentSkippedFiltered = "skipped-filtered"
+	attachmentSkippedOversize = "skipped-oversize"
+	attachmentCorrupt         = "corrupt"
+	attachmentFailed          = "failed"
+)
+
+//getAttachmentFilterOutcome - returns the skipped outcome and reason when a ServiceNow attachment is excluded by the
+//Attachments size, content type and extension filters, or an empty outcome when the attachment should be imported
+func getAttachmentFilterOutcome(fileRecord fileAssocStruct) (string, string) {
+	attachmentsConf := snImportConf.Attachments
+	if attachmentsConf.MaxSizeBytes > 0 && fileRecord.SizeU > attachmentsConf.MaxSizeBytes {
+		return attachmentSkippedOversize, fmt.Sprintf("size %.0f bytes exceeds MaxSizeBytes %.0f", fileRecord.SizeU, attachmentsConf.MaxSizeBytes)
+	}
+	if len(attachmentsConf.IncludeContentTypes) > 0 && !matchContentType(fileRecord.ContentType, attachmentsConf.IncludeContentTypes) {
+		return attachmentSkippedFiltered, "content type [" + fileRecord.ContentType + "] not in IncludeContentTypes"
+	}
+	if matchContentType(fileRecord.ContentType, attachmentsConf.ExcludeContentTypes) {
+		return attachmentSkippedFiltered, "content type [" + fileRecord.ContentType + "] in ExcludeContentTypes"
+	}
+	strExtension := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileRecord.FileName), "."))
+	if len(attachmentsConf.IncludeExtensions) > 0 && !matchExtension(strExtension, attachmentsConf.IncludeExtensions) {
+		return attachmentSkippedFiltered, "extension [" + strExtension + "] not in IncludeExtensions"
+	}
+	if matchExtension(strExtension, attachmentsConf.ExcludeExtensions) {
+		return attachmentSkippedFiltered, "extension [" + strExtension + "] in ExcludeExtensions"
+	}
+	return "", ""
+}
+
+//matchContentType - returns true if the content type matches any of the patterns, where a pattern such as image/* matches all subtypes
+func matchContentType(contentType string, patterns []string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == contentType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+//matchExtension - returns true if the file extension is in the list of extensions, which may be given with or without the leading dot
+func matchExtension(extension string, extensions []string) bool {
+	for _, listExtension := range extensions {
+		if strings.ToLower(strings.TrimPrefix(strings.TrimSpace(listExtension), ".")) == extension {
+			return true
+		}
+	}
+	return false
+}
+
+//recordAttachmentOutcome - counts the outcome of a ServiceNow attachment, and records it in the SN_Attachments CSV report
+func recordAttachmentOutcome(fileRecord fileAssocStruct, snCallRef, outcome, detail string) {
+	if outcome != attachmentAttached && outcome != attachmentExported {
+		logger(5, "Attachment ["+fileRecord.FileName+"] of ["+snCallRef+"] "+outcome+": "+detail, false)
+	}
+	counters.Lock()
+	if counters.attachmentOutcomes == nil {
+		counters.attachmentOutcomes = make(map[string]int)
+	}
+	counters.attachmentOutcomes[outcome]++
+	counters.Unlock()
+	writeReportRow("SN_Attachments",
+		[]string{"ServiceNow Task", "Hornbill Request", "Attachment Sys ID", "File Name", "Content Type", "Size Bytes", "Outcome", "Detail"},
+		[]string{snCallRef, fileRecord.SMCallRef, fileRecord.FileGUID, fileRecord.FileName, fileRecord.ContentType, fmt.Sprintf("%.0f", fileRecord.SizeU), outcome, detail})
+}
+
+//outputAttachmentOutcomes - outputs the attachments not attached per outcome to the import summary
+func outputAttachmentOutcomes() {
+	var outcomes []string
+	for outcome := range counters.attachmentOutcomes {
+		if outcome != attachmentAttached && outcome != attachmentExported {
+			outcomes = append(outcomes, outcome)
+		}
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		logger(1, "Files Not Attached ("+outcome+"): "+fmt.Sprintf("%d", counters.attachmentOutcomes[outcome]), true)
+	}
+}
+
+//Read - reads the decompressed file content, counting the bytes read
+func (stream *attachmentStream) Read(p []byte) (int, error) {
+	n, err := stream.reader.Read(p)
+	stream.size += int64(n)
+	if err != nil && err != io.EOF && stream.err == nil {
+		stream.err = err
+	}
+	return n, err
+}
+
+//getAttachmentFileName - returns the attachment file name with the characters not allowed in Hornbill file names replaced
+func getAttachmentFileName(fileName string) string {
+	filenameReplacer := strings.NewReplacer("<", "_", ">", "_", "|", "_", "\\", "_", "/", "_", ":", "_", "*", "_", "?", "_", "\"", "_")
+	return filenameReplacer.Replace(fileName)
+}
+
+//getAttachmentUploadID - returns the name of the session folder an attachment is uploaded to. The same sys_attachment record can be
+//imported against more than one request at once (a flagged Problem is also imported as a Known Error), so the folder is named after
+//both the Service Manager request and the attachment
+func getAttachmentUploadID(requestAttachment fileAssocStruct) string {
+	return requestAttachment.SMCallRef + "_" + requestAttachment.FileGUID
+}
+
+//uploadAttachmentStream - streams the file content to a folder of its own in the session folder of the Hornbill instance DAV endpoint,
+//so files of the same name being imported concurrently do not collide, and returns the server file name to attach to the request.
+//The content is sent with chunked transfer encoding, so the file is never held in memory in full
+func uploadAttachmentStream(uploadID, fileName string, fileContent io.Reader) (string, error) {
+	folderURL, err := getAttachmentUploadFolder(uploadID)
+	if err != nil {
+		return "", err
+	}
+	//A folder that already exists is returned as 405 Method Not Allowed, and can be uploaded to
+	statusCode, err := sendDavRequest("MKCOL", folderURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if statusCode != http.StatusCreated && statusCode != http.StatusOK && statusCode != http.StatusMethodNotAllowed {
+		return "", fmt.Errorf("unable to create session folder: HTTP %d", statusCode)
+	}
+	statusCode, err = sendDavRequest("PUT", folderURL+url.PathEscape(fileName), fileContent)
+	if err != nil {
+		return "", err
+	}
+	if statusCode != http.StatusCreated && statusCode != http.StatusOK && statusCode != http.StatusNoContent {
+		return "", fmt.Errorf("unable to upload file: HTTP %d", statusCode)
+	}
+	return uploadID + "/" + fileName, nil
+}
+
+//getAttachmentUploadFolder - returns the URL of the session folder an attachment is uploaded to on the Hornbill instance DAV endpoint
+func getAttachmentUploadFolder(uploadID string) (string, error) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return "", err
+	}
+	if espXmlmc.DavEndpoint == "" {
+		return "", errors.New("no DAV endpoint for instance [" + snImportConf.HBConf.InstanceID + "]")
+	}
+	return espXmlmc.DavEndpoint + "session/" + url.PathEscape(uploadID) + "/", nil
+}
+
+//deleteAttachmentUpload - removes the session folder of an uploaded attachment once it has been attached to its request,
+//or could not be attached, so uploads are not left on the instance
+func deleteAttachmentUpload(uploadID string) {
+	folderURL, err := getAttachmentUploadFolder(uploadID)
+	if err != nil {
+		logger(5, "Unable to remove uploaded attachment ["+uploadID+"] from the session folder: "+err.Error(), false)
+		return
+	}
+	statusCode, err := sendDavRequest("DELETE", folderURL, nil)
+	if err != nil {
+		logger(5, "Unable to remove uploaded attachment ["+uploadID+"] from the session folder: "+err.Error(), false)
+		return
+	}
+	if statusCode != http.StatusOK && statusCode != http.StatusNoContent && statusCode != http.StatusNotFound {
+		logger(5, fmt.Sprintf("Unable to remove uploaded attachment [%s] from the session folder: HTTP %d", uploadID, statusCode), false)
+	}
+}
+
+//sendDavRequest - sends a request to the Hornbill instance DAV endpoint, authenticated with the API key, and returns the response status code
+func sendDavRequest(method, davURL string, body io.Reader) (int, error) {
+	req, err := http.NewRequest(method, davURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "ESP-APIKEY "+snImportConf.HBConf.APIKey)
+	resp, err := davClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	//Drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Attachment Source Structs
+type attachmentSourceConfStruct struct {
+	Type         string
+	PathTemplate string
+	Compressed   bool
+	S3           s3SourceConfStruct
+}
+
+type s3SourceConfStruct struct {
+	Endpoint      string
+	Bucket        string
+	KeyTemplate   string
+	Region        string
+	AccessKey     string
+	SecretKey     string
+	SessionToken  string
+	VirtualHosted bool
+}
+
+//attachmentSourceError - an error reading the content of an attachment from its source, as opposed to an error decoding the content read
+type attachmentSourceError struct {
+	err error
+}
+
+//attachmentChunkReader - reads the file content of an attachment from its sys_attachment_doc rows, decoding one chunk at a time
+type attachmentChunkReader struct {
+	rows    *sqlx.Rows
+	pending []byte
+}
+
+//attachmentSourceReader - reads the file content of an attachment from an external store, returning errors as attachment source errors
+type attachmentSourceReader struct {
+	reader io.ReadCloser
+}
+
+func (sourceErr *attachmentSourceError) Error() string {
+	return sourceErr.err.Error()
+}
+
+func (sourceErr *attachmentSourceError) Unwrap() error {
+	return sourceErr.err
+}
+
+//getAttachmentSourceType - returns where the attachment content is read from: database (default), filesystem or s3
+func getAttachmentSourceType() string {
+	strType := strings.ToLower(snImportConf.Attachments.Source.Type)
+	if strType != "filesystem" && strType != "s3" {
+		return "database"
+	}
+	return strType
+}
+
+//isAttachmentSourceCompressed - returns true if the attachment content read from the source is gzip compressed, which it always is
+//in sys_attachment_doc, and is as per the Source Compressed option for external stores
+func isAttachmentSourceCompressed() bool {
+	return getAttachmentSourceType() == "database" || snImportConf.Attachments.Source.Compressed
+}
+
+//openAttachmentContent - opens a reader over the content of an attachment, from the configured attachment source
+func openAttachmentContent(db *sqlx.DB, fileRecord fileAssocStruct, snCallRef string) (io.ReadCloser, error) {
+	switch getAttachmentSourceType() {
+	case "filesystem":
+		return openFilesystemAttachment(fileRecord, snCallRef)
+	case "s3":
+		return openS3Attachment(fileRecord, snCallRef)
+	}
+	return openDatabaseAttachment(db, fileRecord)
+}
+
+//getAttachmentReadOutcome - returns the outcome and reason for an error reading the content of an attachment, where errors reading from
+//the source fail the attachment, and errors decoding or decompressing the content mark it as corrupt
+func getAttachmentReadOutcome(err error) (string, string) {
+	var sourceErr *attachmentSourceError
+	if errors.As(err, &sourceErr) {
+		return attachmentFailed, "unable to read attachment data: " + sourceErr.Error()
+	}
+	return attachmentCorrupt, "unable to decode attachment: " + err.Error()
+}
+
+//getAttachmentSourceMap - returns the values of an attachment that can be used in the source path and key templates
+func getAttachmentSourceMap(fileRecord fileAssocStruct, snCallRef string) map[string]interface{} {
+	return map[string]interface{}{
+		"sys_id":       fileRecord.FileGUID,
+		"file_name":    fileRecord.FileName,
+		"content_type": fileRecord.ContentType,
+		"table_name":   fileRecord.TableName,
+		"table_sys_id": fileRecord.TableSysID,
+		"task_ref":     snCallRef,
+		"request_ref":  fileRecord.SMCallRef,
+	}
+}
+
+//openDatabaseAttachment - opens a reader over the sys_attachment_doc chunks of an attachment
+func openDatabaseAttachment(db *sqlx.DB, fileRecord fileAssocStruct) (io.ReadCloser, error) {
+	//Now go get each of the file chunks for processing
+	sqlFileDataQuery := "SELECT position, length, data "
+	sqlFileDataQuery += " FROM sys_attachment_doc "
+	sqlFileDataQuery += " WHERE sys_attachment = '" + fileRecord.FileGUID + "'"
+	sqlFileDataQuery += " ORDER BY position ASC"
+
+	if configDebug {
+		logger(1, "[DATABASE] Request File Attachments Query: "+sqlFileDataQuery, false)
+	}
+
+	//Run Query
+	attachmentRowData, err := db.Queryx(sqlFileDataQuery)
+	if err != nil {
+		logger(4, " Database Query Error: "+err.Error(), false)
+		return nil, err
+	}
+	return &attachmentChunkReader{rows: attachmentRowData}, nil
+}
+
+//Read - returns the decoded content of the next sys_attachment_doc chunks, reading the next row only when the current chunk has been consumed
+func (chunkReader *attachmentChunkReader) Read(p []byte) (int, error) {
+	for len(chunkReader.pending) == 0 {
+		if !chunkReader.rows.Next() {
+			if err := chunkReader.rows.Err(); err != nil {
+				return 0, &attachmentSourceError{err}
+			}
+			return 0, io.EOF
+		}
+		var rowAttachmentData fileAssocDataStruct
+		if err := chunkReader.rows.StructScan(&rowAttachmentData); err != nil {
+			return 0, &attachmentSourceError{err}
+		}
+		//Decode Base64 string in to byte slice
+		decoded, err := base64.StdEncoding.DecodeString(rowAttachmentData.Data)
+		if err != nil {
+			return 0, fmt.Errorf("chunk %d: %v", rowAttachmentData.Position, err)
+		}
+		chunkReader.pending = decoded
+	}
+	n := copy(p, chunkReader.pending)
+	chunkReader.pending = chunkReader.pending[n:]
+	return n, nil
+}
+
+//Close - closes the sys_attachment_doc rows of the attachment
+func (chunkReader *attachmentChunkReader) Close() error {
+	return chunkReader.rows.Close()
+}
+
+//Read - reads the attachment content from the external store
+func (sourceReader *attachmentSourceReader) Read(p []byte) (int, error) {
+	n, err := sourceReader.reader.Read(p)
+	if err != nil && err != io.EOF {
+		return n, &attachmentSourceError{err}
+	}
+	return n, err
+}
+
+//Close - closes the attachment content of the external store
+func (sourceReader *attachmentSourceReader) Close() error {
+	return sourceReader.reader.Close()
+}
+
+//openFilesystemAttachment - opens the file holding the content of an attachment, at the Source PathTemplate. The values substituted in to
+//the template are made safe to use as a single path element, and paths that resolve outside of the folder the template starts with are rejected
+func openFilesystemAttachment(fileRecord fileAssocStruct, snCallRef string) (io.ReadCloser, error) {
+	pathTemplate := snImportConf.Attachments.Source.PathTemplate
+	sourceMap := getAttachmentSourceMap(fileRecord, snCallRef)
+	for k, v := range sourceMap {
+		sourceMap[k] = getPathElement(fmt.Sprintf("%v", v))
+	}
+	filePath := filepath.Clean(getFieldValue(pathTemplate, sourceMap))
+	templateRoot := pathTemplate
+	if placeholderIndex := strings.Index(pathTemplate, "["); placeholderIndex >= 0 {
+		templateRoot = filepath.Dir(pathTemplate[:placeholderIndex] + "x")
+	}
+	relativePath, err := filepath.Rel(filepath.Clean(templateRoot), filePath)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return nil, errors.New("path [" + filePath + "] is outside of [" + templateRoot + "]")
+	}
+	if configDebug {
+		logger(1, "[ATTACHMENT] Reading ["+fileRecord.FileName+"] from ["+filePath+"]", false)
+	}
+	sourceFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &attachmentSourceReader{reader: sourceFile}, nil
+}
+
+//getPathElement - returns a value that is safe to use as a single element of a file path, with the path separators and other
+//characters not allowed in file names replaced, and the . and .. elements replaced
+func getPathElement(value string) string {
+	value = getAttachmentFileName(value)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+//openS3Attachment - opens the object holding the content of an attachment in an S3-compatible store, at the Source S3 KeyTemplate.
+//Requests are signed with AWS Signature Version 4 when an AccessKey is configured, and sent unsigned otherwise
+func openS3Attachment(fileRecord fileAssocStruct, snCallRef string) (io.ReadCloser, error) {
+	s3Conf := snImportConf.Attachments.Source.S3
+	endpointURL, err := url.Parse(strings.TrimSuffix(s3Conf.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	objectKey := strings.TrimPrefix(getFieldValue(s3Conf.KeyTemplate, getAttachmentSourceMap(fileRecord, snCallRef)), "/")
+	if s3Conf.VirtualHosted {
+		endpointURL.Host = s3Conf.Bucket + "." + endpointURL.Host
+		endpointURL.Path += "/" + objectKey
+	} else {
+		endpointURL.Path += "/" + s3Conf.Bucket + "/" + objectKey
+	}
+	endpointURL.RawPath = getS3URIEncoded(endpointURL.Path)
+	if configDebug {
+		logger(1, "[ATTACHMENT] Reading ["+fileRecord.FileName+"] from ["+endpointURL.String()+"]", false)
+	}
+	req, err := http.NewRequest("GET", endpointURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s3Conf.AccessKey != "" {
+		signS3Request(req, s3Conf, time.Now().UTC())
+	}
+	resp, err := davClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		//Drain the body so the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to read object [%s]: HTTP %d", objectKey, resp.StatusCode)
+	}
+	return &attachmentSourceReader{reader: resp.Body}, nil
+}
+
+//signS3Request - signs a request to an S3-compatible store with AWS Signature Version 4, for a request without a payload
+func signS3Request(req *http.Request, s3Conf s3SourceConfStruct, signTime time.Time) {
+	region := s3Conf.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := signTime.Format("20060102T150405Z")
+	dateStamp := signTime.Format("20060102")
+	payloadHash := hex.EncodeToString(getSHA256([]byte("")))
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s3Conf.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s3Conf.SessionToken)
+	}
+
+	//Canonical headers are the host and all headers set on the request, in lower case and sorted by name
+	signHeaders := map[string]string{"host": req.URL.Host}
+	for headerName := range req.Header {
+		signHeaders[strings.ToLower(headerName)] = strings.TrimSpace(req.Header.Get(headerName))
+	}
+	var headerNames []string
+	for headerName := range signHeaders {
+		headerNames = append(headerNames, headerName)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := ""
+	for _, headerName := range headerNames {
+		canonicalHeaders += headerName + ":" + signHeaders[headerName] + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.Query().Encode() + "\n" + canonicalHeaders + "\n" + signedHeaders + "\n" + payloadHash
+	credentialScope := dateStamp + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(getSHA256([]byte(canonicalRequest)))
+	signature := getSigV4Signature(s3Conf.SecretKey, dateStamp, region, "s3", stringToSign)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s3Conf.AccessKey+"/"+credentialScope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+//getSigV4Signature - returns the AWS Signature Version 4 signature of a string to sign, using the signing key derived from the secret key
+func getSigV4Signature(secretKey, dateStamp, region, service, stringToSign string) string {
+	signingKey := getHMACSHA256([]byte("AWS4"+secretKey), dateStamp)
+	signingKey = getHMACSHA256(signingKey, region)
+	signingKey = getHMACSHA256(signingKey, service)
+	signingKey = getHMACSHA256(signingKey, "aws4_request")
+	return hex.EncodeToString(getHMACSHA256(signingKey, stringToSign))
+}
+
+//getS3URIEncoded - returns a path with each segment URI encoded as required by Signature Version 4, where only the unreserved
+//characters A-Z, a-z, 0-9, hyphen, underscore, period and tilde are not encoded
+func getS3URIEncoded(path string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(path) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func getSHA256(data []byte) []byte {
+	hashSum := sha256.Sum256(data)
+	return hashSum[:]
+}
+
+func getHMACSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/hornbill/pb"
+	"github.com/hornbill/sqlx"
+)
+
+//----- Catalog Hierarchy Structs
+type catalogHierarchyConfStruct struct {
+	Enabled  bool
+	TaskMode string
+	Tasks    snActivityConfStruct
+}
+
+//processCatalogTasks - imports the sc_task children of the sc_req_item requests imported for the current class,
+//either as activities against the imported request or as linked child requests
+func processCatalogTasks() {
+	catalogTaskConf := mapGenericConf.CatalogHierarchy.Tasks
+	if catalogTaskConf.Name == "" {
+		catalogTaskConf.Name = "Catalog Tasks"
+	}
+	switch mapGenericConf.CatalogHierarchy.TaskMode {
+	case "request":
+		processCatalogTaskRequests(catalogTaskConf)
+	default:
+		processActivities(catalogTaskConf)
+	}
+}
+
+//processCatalogTaskRequests - logs each catalog task as a request of the current class, linked as a child of its imported request item
+func processCatalogTaskRequests(catalogTaskConf snActivityConfStruct) {
+	time.Sleep(100 * time.Millisecond)
+	logger(1, "Processing Catalog Tasks, please wait...", true)
+	arrActivityDetailsMaps, boolQueryOk := queryDBActivityDetails(catalogTaskConf, connStrAppDB)
+	if !boolQueryOk {
+		logger(4, "Request Search Failed for Catalog Tasks.", true)
+		return
+	}
+	bar := pb.StartNew(len(arrActivityDetailsMaps))
+	maxGoroutinesGuard := make(chan struct{}, maxGoroutines)
+	for _, taskRecord := range arrActivityDetailsMaps {
+		maxGoroutinesGuard <- struct{}{}
+		wgRequest.Add(1)
+		taskRecordArr := taskRecord
+		taskRecordCallref := fmt.Sprintf("%s", taskRecord["callref"])
+		parentItemRef := getFieldValue(catalogTaskConf.ParentRef, taskRecordArr)
+
+		go func() {
+			defer wgRequest.Done()
+			time.Sleep(1 * time.Millisecond)
+			mutexBar.Lock()
+			bar.Increment()
+			mutexBar.Unlock()
+			mutexArrCallsLogged.Lock()
+			smImported, impOk := arrCallsLogged[parentItemRef]
+			mutexArrCallsLogged.Unlock()
+			if !impOk || smImported.SMCallRef == "" {
+				logger(5, "Catalog Task ["+taskRecordCallref+"] not imported, as its Request Item ["+parentItemRef+"] was not imported", false)
+				<-maxGoroutinesGuard
+				return
+			}
+			boolCallLogged, hbCallRef := logNewCall(mapGenericConf.CallClass, taskRecordArr, taskRecordCallref)
+			if boolCallLogged && hbCallRef != "" && hbCallRef != "Dry Run" {
+				logger(3, "[REQUEST] Request "+hbCallRef+" raised from Catalog Task "+taskRecordCallref, false)
+				addAssocRecord(smImported.SMCallRef, hbCallRef, "Catalog Task")
+			} else if !boolCallLogged {
+				logger(4, "Catalog Task request log failed: "+taskRecordCallref, false)
+			}
+			<-maxGoroutinesGuard
+		}()
+	}
+	wgRequest.Wait()
+	bar.FinishPrint("Catalog Task Import Complete")
+}
+
+//----- Catalog Variable Structs
+type catalogVariablesConfStruct struct {
+	Import bool
+	Target string
+}
+
+type catalogVariableStruct struct {
+	QuestionID string `db:"question_id"`
+	Question   string `db:"question"`
+	Answer     string `db:"answer"`
+	FormName   string `db:"form_name"`
+}
+
+//processCatalogVariables - imports the variable questions and answers of a ServiceNow request item against the imported request,
+//as Request Questions and/or appended to the request description
+func processCatalogVariables(smCallRef, snTaskSysID, strDescription string) {
+	catalogVariables := getCatalogVariables(snTaskSysID)
+	if len(catalogVariables) == 0 {
+		return
+	}
+	strTarget := mapGenericConf.CatalogVariables.Target
+	if strTarget == "" || strTarget == "questions" || strTarget == "both" {
+		for _, catalogVariable := range catalogVariables {
+			addRequestQuestion(smCallRef, catalogVariable)
+		}
+	}
+	if strTarget == "description" || strTarget == "both" {
+		strVariables := ""
+		for _, catalogVariable := range catalogVariables {
+			strVariables += "\n" + catalogVariable.Question + ": " + catalogVariable.Answer
+		}
+		if strDescription != "" {
+			strDescription += "\n\n"
+		}
+		strDescription += "'''Catalog Variables'''\n" + strVariables
+		updateRequestDescription(smCallRef, strDescription)
+	}
+}
+
+//getCatalogVariables - returns the variable questions and answers of a ServiceNow request item, in their original order
+func getCatalogVariables(snTaskSysID string) []catalogVariableStruct {
+	var catalogVariables []catalogVariableStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Catalog Variables: "+err.Error(), false)
+		return catalogVariables
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Catalog Variables: "+err.Error(), false)
+		return catalogVariables
+	}
+	sqlVariableQuery := "SELECT item_option_new.name AS question_id, "
+	sqlVariableQuery += " COALESCE(item_option_new.question_text, item_option_new.name) AS question, "
+	sqlVariableQuery += " COALESCE((SELECT MIN(question_choice.text) FROM question_choice WHERE question_choice.question = item_option_new.sys_id AND question_choice.value = sc_item_option.value), sc_item_option.value, '') AS answer, "
+	sqlVariableQuery += " COALESCE(sc_cat_item.name, '') AS form_name "
+	sqlVariableQuery += " FROM sc_item_option_mtom "
+	sqlVariableQuery += " JOIN sc_item_option ON sc_item_option_mtom.sc_item_option = sc_item_option.sys_id "
+	sqlVariableQuery += " JOIN item_option_new ON sc_item_option.item_option_new = item_option_new.sys_id "
+	sqlVariableQuery += " LEFT JOIN sc_cat_item ON item_option_new.cat_item = sc_cat_item.sys_id "
+	sqlVariableQuery += " WHERE sc_item_option_mtom.request_item = '" + snTaskSysID + "'"
+	sqlVariableQuery += " ORDER BY item_option_new." + quoteIdentifier("order") + " ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Catalog Variables Query: "+sqlVariableQuery, false)
+	}
+	err = db.Select(&catalogVariables, sqlVariableQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Catalog Variables: "+err.Error(), false)
+	}
+	return catalogVariables
+}
+
+//addRequestQuestion - adds a catalog variable question and answer to an imported request
+func addRequestQuestion(smCallRef string, catalogVariable catalogVariableStruct) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "RequestQuestions")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_request_id", smCallRef)
+	if catalogVariable.FormName != "" {
+		espXmlmc.SetParam("h_form_name", catalogVariable.FormName)
+	}
+	espXmlmc.SetParam("h_question_id", catalogVariable.QuestionID)
+	espXmlmc.SetParam("h_question", catalogVariable.Question)
+	espXmlmc.SetParam("h_answer", catalogVariable.Answer)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLQuestion, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to add Request Question ["+catalogVariable.QuestionID+"] to ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLQuestion), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read response from Hornbill instance for Request Question ["+catalogVariable.QuestionID+"] on ["+smCallRef+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to add Request Question ["+catalogVariable.QuestionID+"] to ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+	}
+}
+
+//updateRequestDescription - replaces the description of an imported request
+func updateRequestDescription(smCallRef, strDescription string) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_reference", smCallRef)
+	espXmlmc.SetParam("h_description", strDescription)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to update Description of request ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to update Description of request ["+smCallRef+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to update Description of request ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+	}
+}
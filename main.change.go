@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+//----- Change Request Structs
+type changeFieldsConfStruct struct {
+	FieldMapping map[string]interface{}
+	ValueMapping map[string]map[string]interface{}
+	PlanUpdates  map[string]interface{}
+}
+
+//getCallTypeFields - returns the "Call Type" related record columns of a new request, from the class AdditionalFieldMapping
+//overlaid with the class ChangeFields mapping. Change requests with a planned start and end are flagged as scheduled,
+//so they appear on the change calendar
+func getCallTypeFields(callMap map[string]interface{}) map[string]string {
+	callTypeFields := make(map[string]string)
+	for k, v := range mapGenericConf.AdditionalFieldMapping {
+		strMapping := fmt.Sprintf("%v", v)
+		if strMapping != "" && getFieldValue(strMapping, callMap) != "" {
+			callTypeFields[k] = getFieldValue(strMapping, callMap)
+		}
+	}
+	if len(mapGenericConf.ChangeFields.FieldMapping) == 0 {
+		return callTypeFields
+	}
+	for k, v := range mapGenericConf.ChangeFields.FieldMapping {
+		strMapping := fmt.Sprintf("%v", v)
+		strValue := getFieldValue(strMapping, callMap)
+		if strMapping == "" || strValue == "" {
+			continue
+		}
+		callTypeFields[k] = getChangeFieldValue(k, strValue)
+	}
+	if _, ok := mapGenericConf.ChangeFields.FieldMapping["h_scheduled"]; !ok && callTypeFields["h_start_time"] != "" && callTypeFields["h_end_time"] != "" {
+		callTypeFields["h_scheduled"] = "1"
+	}
+	return callTypeFields
+}
+
+//getChangeFieldValue - maps a ServiceNow change value through the ValueMapping of its Hornbill column, such as the change type or risk.
+//Values not in the mapping are returned as-is
+func getChangeFieldValue(strColumn, snValue string) string {
+	valueMapping, ok := mapGenericConf.ChangeFields.ValueMapping[strColumn]
+	if !ok || valueMapping[snValue] == nil {
+		return snValue
+	}
+	return fmt.Sprintf("%v", valueMapping[snValue])
+}
+
+//addChangePlanUpdates - adds each populated change plan, such as the backout and test plans, as a Historic Update against the imported request,
+//by the ServiceNow user the request was created by
+func addChangePlanUpdates(smCallRef, strLoggedDate string, callMap map[string]interface{}) {
+	snCreatedBy := ""
+	if createdByMapping, ok := mapGenericConf.CoreFieldMapping["h_createdby"]; ok {
+		snCreatedBy = getFieldValue(fmt.Sprintf("%v", createdByMapping), callMap)
+	}
+	updateByID, updateByName, updateByType := getHistoricUpdateAuthor(snCreatedBy)
+	var planLabels []string
+	for planLabel := range mapGenericConf.ChangeFields.PlanUpdates {
+		planLabels = append(planLabels, planLabel)
+	}
+	sort.Strings(planLabels)
+	for _, planLabel := range planLabels {
+		strPlan := getFieldValue(fmt.Sprintf("%v", mapGenericConf.ChangeFields.PlanUpdates[planLabel]), callMap)
+		if strPlan == "" {
+			continue
+		}
+		addHistoricUpdate(smCallRef, strLoggedDate, getHistoricUpdateIndex(smCallRef), updateByID, updateByName, updateByType, planLabel, strPlan)
+	}
+}
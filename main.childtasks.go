@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Child Task Structs
+type childTasksConfStruct struct {
+	Import        bool
+	Tables        []string
+	Category      string
+	StatusMapping map[string]interface{}
+	AppendJournal bool
+}
+
+type activityJournalStruct struct {
+	Element   string `db:"element"`
+	Value     string `db:"value"`
+	CreatedBy string `db:"sys_created_by"`
+	CreatedOn string `db:"sys_created_on"`
+}
+
+//processChildTasks - imports the ServiceNow change_task and problem_task records as activities against their imported parent requests
+func processChildTasks() {
+	if !snImportConf.ChildTasks.Import {
+		return
+	}
+	processActivities(getChildTaskActivityConf())
+}
+
+//getChildTaskActivityConf - builds the activity definition for the child task tables, with its built-in query and mapping
+func getChildTaskActivityConf() snActivityConfStruct {
+	childTaskTables := snImportConf.ChildTasks.Tables
+	if len(childTaskTables) == 0 {
+		childTaskTables = []string{"change_task", "problem_task"}
+	}
+	var tableList []string
+	for _, tableName := range childTaskTables {
+		tableList = append(tableList, "'"+strings.Replace(tableName, "'", "''", -1)+"'")
+	}
+	strCategory := snImportConf.ChildTasks.Category
+	if strCategory == "" {
+		strCategory = "Task"
+	}
+	childTaskConf := snActivityConfStruct{
+		Name:          "Child Tasks",
+		Import:        true,
+		Category:      strCategory,
+		ParentRef:     "[parent_ref]",
+		Title:         "[callref]: [short_description]",
+		Description:   "[description]",
+		StartDate:     "[start_date]",
+		DueDate:       "[due_date]",
+		AssignTo:      "[owner_username]",
+		AssignToTeam:  "[support_group]",
+		AppendJournal: snImportConf.ChildTasks.AppendJournal,
+		Status:        "[task_state]",
+		CreatedDate:   "[logdate]",
+		CompletedDate: "[closed_at]",
+		CompletedBy:   "[closed_by]",
+		StatusMapping: snImportConf.ChildTasks.StatusMapping,
+	}
+	childTaskConf.SQLStatement = map[string]interface{}{
+		"0": "SELECT task.sys_id AS task_guid, task.sys_class_name AS callclass, task.number AS callref, parent_task.number AS parent_ref, ",
+		"1": "task.short_description, task.description, task.opened_at AS logdate, task.due_date, task.closed_at, ",
+		"2": "COALESCE(task.work_start, task.expected_start) AS start_date, ",
+		"3": "(SELECT label FROM sys_choice WHERE name = 'task' AND element = 'state' AND value = task.state) AS task_state, ",
+		"4": "(SELECT user_name FROM sys_user WHERE sys_id = task.assigned_to) AS owner_username, ",
+		"5": "(SELECT user_name FROM sys_user WHERE sys_id = task.closed_by) AS closed_by, ",
+		"6": "(SELECT name FROM sys_user_group WHERE sys_id = task.assignment_group) AS support_group ",
+		"7": "FROM task ",
+		"8": "JOIN task parent_task ON COALESCE(task.parent, task.change_request, task.problem) = parent_task.sys_id ",
+		"9": "WHERE task.sys_class_name IN (" + strings.Join(tableList, ", ") + ")",
+	}
+	return childTaskConf
+}
+
+//getActivityJournal - returns the journal entries of a ServiceNow task, formatted to append to an activity description
+func getActivityJournal(snTaskSysID string) string {
+	strJournal := ""
+	if snTaskSysID == "" || snTaskSysID == "%!s(<nil>)" {
+		return strJournal
+	}
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Activity Journal: "+err.Error(), false)
+		return strJournal
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Activity Journal: "+err.Error(), false)
+		return strJournal
+	}
+	sqlJournalQuery := "SELECT element, COALESCE(value, '') AS value, COALESCE(sys_created_by, '') AS sys_created_by, sys_created_on "
+	sqlJournalQuery += " FROM sys_journal_field WHERE element_id = '" + snTaskSysID + "'"
+	sqlJournalQuery += getJournalElementFilter()
+	sqlJournalQuery += " ORDER BY sys_created_on ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Activity Journal Query: "+sqlJournalQuery, false)
+	}
+	var journalEntries []activityJournalStruct
+	err = db.Select(&journalEntries, sqlJournalQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Activity Journal: "+err.Error(), false)
+		return strJournal
+	}
+	for _, journalEntry := range journalEntries {
+		strJournal += fmt.Sprintf("\n\n%s - %s (%s):\n%s", journalEntry.CreatedOn, getJournalElement(journalEntry.Element).Label, journalEntry.CreatedBy, journalEntry.Value)
+	}
+	return strJournal
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Email Structs
+type emailConfStruct struct {
+	Import      bool
+	Target      string
+	Visibility  string
+	Attachments bool
+}
+
+type taskEmailStruct struct {
+	SysID      string         `db:"sys_id"`
+	Type       string         `db:"type"`
+	Sender     string         `db:"sender"`
+	Recipients string         `db:"recipients"`
+	Copied     string         `db:"copied"`
+	Subject    string         `db:"subject"`
+	Body       string         `db:"body"`
+	BodyText   string         `db:"body_text"`
+	CreatedOn  sql.NullString `db:"sys_created_on"`
+}
+
+var (
+	regexEmailTags       = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>|<[^>]+>`)
+	regexEmailLineBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</tr>`)
+	regexEmailBlankLines = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+//processTaskEmails - imports the emails sent and received against a ServiceNow task as Historic Updates and/or timeline entries
+//against the imported request, with their attachments attached to the request where configured
+func processTaskEmails(smCallRef, snCallRef, snTaskSysID string) {
+	strTarget := strings.ToLower(mapGenericConf.Emails.Target)
+	for _, taskEmail := range getTaskEmails(snTaskSysID) {
+		strDirection := "Outbound"
+		if strings.EqualFold(taskEmail.Type, "received") {
+			strDirection = "Inbound"
+		}
+		strEmail := "From: " + taskEmail.Sender + "\nTo: " + taskEmail.Recipients
+		if taskEmail.Copied != "" {
+			strEmail += "\nCc: " + taskEmail.Copied
+		}
+		strEmail += "\nSubject: " + taskEmail.Subject + "\n\n" + getEmailBodyText(taskEmail)
+		strCreatedOn := getDateTimeValue(taskEmail.CreatedOn)
+
+		if strTarget == "" || strTarget == "historic" || strTarget == "both" {
+			updateByID, updateByName, updateByType := getHistoricUpdateAuthor(taskEmail.Sender)
+			addHistoricUpdate(smCallRef, strCreatedOn, getHistoricUpdateIndex(smCallRef), updateByID, updateByName, updateByType, strDirection+" Email ("+taskEmail.Sender+")", strEmail)
+		}
+		if strTarget == "timeline" || strTarget == "both" {
+			strHeader := getTimelineHeader(strDirection+" Email", taskEmail.Sender, strCreatedOn)
+			postTimelineEntry(smCallRef, strHeader+"\n\n"+strEmail, getTimelineVisibility(mapGenericConf.Emails.Visibility))
+		}
+		if mapGenericConf.Emails.Attachments {
+			processFileAttachments(taskEmail.SysID, snCallRef, smCallRef)
+		}
+	}
+}
+
+//getTaskEmails - returns the sent and received sys_email records of a ServiceNow task, oldest first
+func getTaskEmails(snTaskSysID string) []taskEmailStruct {
+	var taskEmails []taskEmailStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Task Emails: "+err.Error(), false)
+		return taskEmails
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Task Emails: "+err.Error(), false)
+		return taskEmails
+	}
+	sqlEmailQuery := "SELECT sys_id, COALESCE(type, '') AS type, COALESCE(sys_email." + quoteIdentifier("user") + ", sys_created_by, '') AS sender, "
+	sqlEmailQuery += " COALESCE(recipients, '') AS recipients, COALESCE(copied, '') AS copied, COALESCE(subject, '') AS subject, "
+	sqlEmailQuery += " COALESCE(body, '') AS body, COALESCE(body_text, '') AS body_text, sys_created_on "
+	sqlEmailQuery += " FROM sys_email "
+	sqlEmailQuery += " WHERE instance = '" + snTaskSysID + "' AND type IN ('received', 'sent') "
+	sqlEmailQuery += " ORDER BY sys_created_on ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Task Emails Query: "+sqlEmailQuery, false)
+	}
+	err = db.Select(&taskEmails, sqlEmailQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Task Emails: "+err.Error(), false)
+	}
+	return taskEmails
+}
+
+//getEmailBodyText - returns the plain text body of an email, stripping the markup from HTML bodies where there is no text body
+func getEmailBodyText(taskEmail taskEmailStruct) string {
+	strBody := taskEmail.BodyText
+	if strings.TrimSpace(strBody) == "" {
+		strBody = regexEmailLineBreaks.ReplaceAllString(taskEmail.Body, "\n")
+		strBody = regexEmailTags.ReplaceAllString(strBody, "")
+		strBody = html.UnescapeString(strBody)
+	}
+	strBody = strings.Replace(strBody, "\r\n", "\n", -1)
+	strBody = regexEmailBlankLines.ReplaceAllString(strBody, "\n\n")
+	return strings.TrimSpace(strBody)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Known Error Structs
+type knownErrorLinksConfStruct struct {
+	LinkProblem        bool
+	LinkIncidents      bool
+	ProblemRequestType string
+	RelationshipName   string
+}
+
+//knownErrorKeyPrefix - prefixes the ServiceNow reference of known errors in arrCallsLogged, as known errors are imported
+//from the same problem records as the problems, and would otherwise replace the problem entries
+const knownErrorKeyPrefix = "KE:"
+
+//getCallsLoggedKey - returns the arrCallsLogged key for a task of the current class
+func getCallsLoggedKey(snCallRef string) string {
+	if mapGenericConf.CallClass == "Known Error" {
+		return knownErrorKeyPrefix + snCallRef
+	}
+	return snCallRef
+}
+
+//getSNCallRef - returns the ServiceNow reference of a task from its arrCallsLogged key
+func getSNCallRef(callsLoggedKey string) string {
+	return strings.TrimPrefix(callsLoggedKey, knownErrorKeyPrefix)
+}
+
+//linkKnownError - links an imported known error to the problem it was raised from, and to the incidents linked to that problem
+func linkKnownError(smKnownErrorRef, snProblemRef, snProblemSysID string) {
+	relationshipName := mapGenericConf.KnownErrorLinks.RelationshipName
+	if relationshipName == "" {
+		relationshipName = "Known Error"
+	}
+	if mapGenericConf.KnownErrorLinks.LinkProblem {
+		problemRequestType := mapGenericConf.KnownErrorLinks.ProblemRequestType
+		if problemRequestType == "" {
+			problemRequestType = "Problem"
+		}
+		smProblemRef := getSMRequestRefOfType(snProblemRef, problemRequestType)
+		if smProblemRef != "" {
+			addAssocRecord(smProblemRef, smKnownErrorRef, relationshipName)
+		} else {
+			logger(5, "Known Error ["+smKnownErrorRef+"] not linked to Problem ["+snProblemRef+"], as the Problem has not been imported", false)
+		}
+	}
+	if mapGenericConf.KnownErrorLinks.LinkIncidents {
+		for _, snIncidentRef := range getProblemIncidents(snProblemSysID) {
+			smIncidentRef := getSMRequestRefOfType(snIncidentRef, "Incident")
+			if smIncidentRef == "" {
+				if configDebug {
+					logger(1, "Known Error ["+smKnownErrorRef+"] not linked to Incident ["+snIncidentRef+"], as the Incident has not been imported", false)
+				}
+				continue
+			}
+			addAssocRecord(smKnownErrorRef, smIncidentRef, relationshipName)
+		}
+	}
+}
+
+//getProblemIncidents - returns the references of the ServiceNow incidents linked to a problem
+func getProblemIncidents(snProblemSysID string) []string {
+	var incidentRefs []string
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Problem Incidents: "+err.Error(), false)
+		return incidentRefs
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Problem Incidents: "+err.Error(), false)
+		return incidentRefs
+	}
+	sqlIncidentQuery := "SELECT number FROM task WHERE sys_class_name = 'incident' AND problem_id = '" + strings.Replace(snProblemSysID, "'", "''", -1) + "'"
+	if configDebug {
+		logger(1, "[DATABASE] Problem Incidents Query: "+sqlIncidentQuery, false)
+	}
+	err = db.Select(&incidentRefs, sqlIncidentQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Problem Incidents: "+err.Error(), false)
+	}
+	return incidentRefs
+}
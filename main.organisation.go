@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//----- Organisation Structs
+type organisationConfStruct struct {
+	Lookup                     bool
+	MatchOn                    []string
+	CustomerFallback           bool
+	CustomerOrganisationColumn string
+}
+
+type organisationListStruct struct {
+	OrganisationName string
+	OrganisationID   string
+}
+
+type xmlmcOrganisationListResponse struct {
+	MethodResult     string      `xml:"status,attr"`
+	OrganisationID   string      `xml:"params>rowData>row>h_organization_id"`
+	OrganisationName string      `xml:"params>rowData>row>h_organization_name"`
+	State            stateStruct `xml:"state"`
+}
+
+type xmlmcCustomerOrganisationResponse struct {
+	MethodResult string      `xml:"status,attr"`
+	Row          xmlRow      `xml:"params>rowData>row"`
+	State        stateStruct `xml:"state"`
+}
+
+//xmlRow - an entityBrowseRecords2 row, for where the column to read is configurable
+type xmlRow struct {
+	Columns []xmlColumn `xml:",any"`
+}
+
+type xmlColumn struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+var (
+	organisations       []organisationListStruct
+	customerOrgCache    = make(map[string]string)
+	organisationMisses  = make(map[string]bool)
+	mutexOrganisations  = &sync.Mutex{}
+	mutexCustomerOrgIDs = &sync.Mutex{}
+)
+
+//getOrganisation - returns the Hornbill organisation ID and name for a new request, from the ServiceNow company mapped to h_company_name,
+//matched through the CompanyMapping and/or by name, falling back to the organisation of the request customer where configured
+func getOrganisation(callMap map[string]interface{}, customerID string) (string, string) {
+	snCompany := ""
+	if companyMapping, ok := mapGenericConf.CoreFieldMapping["h_company_name"]; ok {
+		snCompany = getFieldValue(fmt.Sprintf("%v", companyMapping), callMap)
+	}
+	matchOn := mapGenericConf.Organisation.MatchOn
+	if len(matchOn) == 0 {
+		matchOn = []string{"mapping", "name"}
+	}
+	if snCompany != "" {
+		for _, matchStrategy := range matchOn {
+			organisationName := ""
+			switch strings.ToLower(matchStrategy) {
+			case "mapping":
+				if snImportConf.CompanyMapping[snCompany] != nil {
+					organisationName = fmt.Sprintf("%v", snImportConf.CompanyMapping[snCompany])
+				}
+			case "name":
+				organisationName = snCompany
+			default:
+				logger(5, "Organisation MatchOn strategy ["+matchStrategy+"] is not supported", false)
+			}
+			if organisationName == "" {
+				continue
+			}
+			if organisationID := getOrganisationID(organisationName); organisationID != "" {
+				return organisationID, organisationName
+			}
+		}
+	}
+	if mapGenericConf.Organisation.CustomerFallback && customerID != "" {
+		organisationID := getCustomerOrganisationID(customerID)
+		if organisationID != "" {
+			return organisationID, getOrganisationName(organisationID)
+		}
+	}
+	//Keep the ServiceNow company name against the request where it could not be matched, and report it
+	if snCompany != "" {
+		logger(5, "Company ["+snCompany+"] of ["+fmt.Sprintf("%s", callMap["callref"])+"] could not be matched to a Hornbill organisation", false)
+		writeReportRow("SN_Unmatched_Companies", []string{"ServiceNow Task", "Company", "Customer"},
+			[]string{fmt.Sprintf("%s", callMap["callref"]), snCompany, customerID})
+	}
+	return "", snCompany
+}
+
+//getOrganisationID - returns the ID of a Hornbill organisation from the cache or the instance
+func getOrganisationID(organisationName string) string {
+	mutexOrganisations.Lock()
+	for _, organisation := range organisations {
+		if strings.EqualFold(organisation.OrganisationName, organisationName) {
+			mutexOrganisations.Unlock()
+			return organisation.OrganisationID
+		}
+	}
+	mutexOrganisations.Unlock()
+	organisationID, _ := searchOrganisation("h_organization_name", organisationName)
+	return organisationID
+}
+
+//getOrganisationName - returns the name of a Hornbill organisation from the cache or the instance
+func getOrganisationName(organisationID string) string {
+	mutexOrganisations.Lock()
+	for _, organisation := range organisations {
+		if organisation.OrganisationID == organisationID {
+			mutexOrganisations.Unlock()
+			return organisation.OrganisationName
+		}
+	}
+	mutexOrganisations.Unlock()
+	_, organisationName := searchOrganisation("h_organization_id", organisationID)
+	return organisationName
+}
+
+//searchOrganisation -- Function to check if the passed-through organisation is on the instance, caching it where found,
+//and caching the searches that found no organisation so they are not repeated
+func searchOrganisation(searchColumn, searchValue string) (string, string) {
+	missKey := searchColumn + ":" + strings.ToLower(searchValue)
+	mutexOrganisations.Lock()
+	boolMissed := organisationMisses[missKey]
+	mutexOrganisations.Unlock()
+	if boolMissed {
+		return "", ""
+	}
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return "", ""
+	}
+	espXmlmc.SetParam("application", "com.hornbill.core")
+	espXmlmc.SetParam("entity", "Organizations")
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", searchColumn)
+	espXmlmc.SetParam("value", searchValue)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", "1")
+
+	XMLOrganisationSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		logger(4, "Unable to Search for Organisation ["+searchValue+"]: "+xmlmcErr.Error(), false)
+		return "", ""
+	}
+	var xmlRespon xmlmcOrganisationListResponse
+	err = xml.Unmarshal([]byte(XMLOrganisationSearch), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to Search for Organisation ["+searchValue+"]: "+err.Error(), false)
+		return "", ""
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to Search for Organisation ["+searchValue+"]: "+xmlRespon.State.ErrorRet, false)
+		return "", ""
+	}
+	if xmlRespon.OrganisationID == "" {
+		mutexOrganisations.Lock()
+		organisationMisses[missKey] = true
+		mutexOrganisations.Unlock()
+		return "", ""
+	}
+	mutexOrganisations.Lock()
+	organisations = append(organisations, organisationListStruct{OrganisationName: xmlRespon.OrganisationName, OrganisationID: xmlRespon.OrganisationID})
+	mutexOrganisations.Unlock()
+	return xmlRespon.OrganisationID, xmlRespon.OrganisationName
+}
+
+//getCustomerOrganisationID - returns the organisation ID held against the Hornbill record of a customer
+func getCustomerOrganisationID(customerID string) string {
+	mutexCustomerOrgIDs.Lock()
+	organisationID, ok := customerOrgCache[customerID]
+	mutexCustomerOrgIDs.Unlock()
+	if ok {
+		return organisationID
+	}
+	organisationColumn := mapGenericConf.Organisation.CustomerOrganisationColumn
+	if organisationColumn == "" {
+		organisationColumn = "h_organization_id"
+	}
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return ""
+	}
+	if snImportConf.CustomerType == "0" {
+		espXmlmc.SetParam("entity", "UserAccount")
+	} else {
+		espXmlmc.SetParam("entity", "Contact")
+	}
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", snImportConf.CustomerUniqueColumn)
+	espXmlmc.SetParam("value", customerID)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", "1")
+
+	XMLCustomerSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		logger(4, "Unable to Search for Organisation of Customer ["+customerID+"]: "+xmlmcErr.Error(), false)
+		return ""
+	}
+	var xmlRespon xmlmcCustomerOrganisationResponse
+	err = xml.Unmarshal([]byte(XMLCustomerSearch), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to Search for Organisation of Customer ["+customerID+"]: "+err.Error(), false)
+		return ""
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to Search for Organisation of Customer ["+customerID+"]: "+xmlRespon.State.ErrorRet, false)
+		return ""
+	}
+	for _, column := range xmlRespon.Row.Columns {
+		if column.XMLName.Local == organisationColumn {
+			organisationID = column.Value
+			break
+		}
+	}
+	mutexCustomerOrgIDs.Lock()
+	customerOrgCache[customerID] = organisationID
+	mutexCustomerOrgIDs.Unlock()
+	return organisationID
+}
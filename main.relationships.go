@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hornbill/pb"
+	"github.com/hornbill/sqlx"
+)
+
+//----- Relationship Structs
+type relationshipConfStruct struct {
+	Import          bool
+	TaskRelTask     bool
+	ReferenceFields []relationshipFieldStruct
+	SearchColumn    string
+	NameColumn      string
+}
+
+type relationshipFieldStruct struct {
+	Field      string
+	Name       string
+	Referenced string
+}
+
+type taskRelationshipStruct struct {
+	ParentRef string `db:"parent_ref"`
+	ChildRef  string `db:"child_ref"`
+	Name      string `db:"rel_name"`
+}
+
+type xmlmcRequestSearchResponse struct {
+	MethodResult string      `xml:"status,attr"`
+	RequestID    string      `xml:"params>rowData>row>h_pk_reference"`
+	State        stateStruct `xml:"state"`
+}
+
+var (
+	relationshipsProcessed = make(map[string]bool)
+	requestRefCache        = make(map[string]string)
+	mutexRelationships     = &sync.Mutex{}
+	mutexRequestRefCache   = &sync.Mutex{}
+)
+
+//processRelationships - reads the relationships of each imported task from ServiceNow, and links the related requests in Hornbill
+func processRelationships() {
+	time.Sleep(100 * time.Millisecond)
+	intRequestsRaised := len(arrCallsLogged)
+	strRequestsRaised := strconv.Itoa(intRequestsRaised)
+	logger(1, "Processing Request Relationships for "+strRequestsRaised+" imported requests. Please wait...", true)
+	bar := pb.StartNew(intRequestsRaised)
+	maxGoroutinesGuard := make(chan struct{}, maxGoroutines)
+	for snCallRef, requestSlice := range arrCallsLogged {
+		snRef := snCallRef
+		snTaskSysID := requestSlice.SNRequestGUID
+		//Known errors are linked as per the KnownErrorLinks of their class, rather than through the relationships of their problem
+		if strings.HasPrefix(snRef, knownErrorKeyPrefix) {
+			mutexBar.Lock()
+			bar.Increment()
+			mutexBar.Unlock()
+			continue
+		}
+
+		maxGoroutinesGuard <- struct{}{}
+		wgAssoc.Add(1)
+		go func() {
+			defer wgAssoc.Done()
+			time.Sleep(1 * time.Millisecond)
+			for _, relationship := range getTaskRelationships(snRef, snTaskSysID) {
+				addTaskRelationship(relationship)
+			}
+			mutexBar.Lock()
+			bar.Increment()
+			mutexBar.Unlock()
+			<-maxGoroutinesGuard
+		}()
+	}
+	wgAssoc.Wait()
+	bar.FinishPrint("Request Relationship Processing Complete")
+	logger(1, "Request Relationship Processing Complete", false)
+}
+
+//getTaskRelationships - returns the task_rel_task and reference field relationships of a ServiceNow task
+func getTaskRelationships(snRef, snTaskSysID string) []taskRelationshipStruct {
+	var relationships []taskRelationshipStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Request Relationships: "+err.Error(), false)
+		return relationships
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Request Relationships: "+err.Error(), false)
+		return relationships
+	}
+
+	if snImportConf.Relationships.TaskRelTask {
+		sqlRelQuery := "SELECT parent_task.number AS parent_ref, child_task.number AS child_ref, COALESCE(task_rel_type.name, '') AS rel_name "
+		sqlRelQuery += " FROM task_rel_task "
+		sqlRelQuery += " JOIN task parent_task ON task_rel_task.parent = parent_task.sys_id "
+		sqlRelQuery += " JOIN task child_task ON task_rel_task.child = child_task.sys_id "
+		sqlRelQuery += " LEFT JOIN task_rel_type ON task_rel_task.type = task_rel_type.sys_id "
+		sqlRelQuery += " WHERE task_rel_task.parent = '" + snTaskSysID + "' OR task_rel_task.child = '" + snTaskSysID + "'"
+		if configDebug {
+			logger(1, "[DATABASE] Request Relationships Query: "+sqlRelQuery, false)
+		}
+		var relRows []taskRelationshipStruct
+		err = db.Select(&relRows, sqlRelQuery)
+		if err != nil {
+			logger(4, " Database Query Error for Request Relationships: "+err.Error(), false)
+		}
+		relationships = append(relationships, relRows...)
+	}
+
+	for _, refField := range snImportConf.Relationships.ReferenceFields {
+		sqlRefQuery := "SELECT ref_task.number FROM task "
+		sqlRefQuery += " JOIN task ref_task ON task." + refField.Field + " = ref_task.sys_id "
+		sqlRefQuery += " WHERE task.sys_id = '" + snTaskSysID + "'"
+		if configDebug {
+			logger(1, "[DATABASE] Request Reference Field Query: "+sqlRefQuery, false)
+		}
+		var refRows []string
+		err = db.Select(&refRows, sqlRefQuery)
+		if err != nil {
+			logger(4, " Database Query Error for Request Reference Field ["+refField.Field+"]: "+err.Error(), false)
+			continue
+		}
+		for _, refTask := range refRows {
+			relationship := taskRelationshipStruct{ParentRef: refTask, ChildRef: snRef, Name: refField.Name}
+			if strings.EqualFold(refField.Referenced, "child") {
+				relationship.ParentRef = snRef
+				relationship.ChildRef = refTask
+			}
+			relationships = append(relationships, relationship)
+		}
+	}
+	return relationships
+}
+
+//addTaskRelationship - resolves both tasks of a ServiceNow relationship to Hornbill requests, and links them once
+func addTaskRelationship(relationship taskRelationshipStruct) {
+	relKey := relationship.ParentRef + "|" + relationship.ChildRef
+	mutexRelationships.Lock()
+	if relationshipsProcessed[relKey] {
+		mutexRelationships.Unlock()
+		return
+	}
+	relationshipsProcessed[relKey] = true
+	mutexRelationships.Unlock()
+
+	smParentRef := getSMRequestRef(relationship.ParentRef)
+	smChildRef := getSMRequestRef(relationship.ChildRef)
+	if smParentRef == "" || smChildRef == "" {
+		if configDebug {
+			logger(1, "Relationship ["+relationship.Name+"] between ["+relationship.ParentRef+"] and ["+relationship.ChildRef+"] skipped, as both tasks have not been imported", false)
+		}
+		return
+	}
+	addAssocRecord(smParentRef, smChildRef, relationship.Name)
+}
+
+//getSMRequestRef - returns the Hornbill request reference of a ServiceNow task, from this run or a previous run of the import
+func getSMRequestRef(snRef string) string {
+	return getSMRequestRefOfType(snRef, "")
+}
+
+//getSMRequestRefOfType - returns the Hornbill request reference of a ServiceNow task, from this run or a previous run of the import,
+//where requests from previous runs must be of the given request type
+func getSMRequestRefOfType(snRef, requestType string) string {
+	if snRef == "" || snRef == "<nil>" {
+		return ""
+	}
+	mutexArrCallsLogged.Lock()
+	smImported, ok := arrCallsLogged[snRef]
+	mutexArrCallsLogged.Unlock()
+	if ok && smImported.SMCallRef != "" {
+		return smImported.SMCallRef
+	}
+
+	cacheKey := snRef
+	if requestType != "" {
+		cacheKey = requestType + "|" + snRef
+	}
+	mutexRequestRefCache.Lock()
+	smCallRef, ok := requestRefCache[cacheKey]
+	mutexRequestRefCache.Unlock()
+	if ok {
+		return smCallRef
+	}
+	smCallRef = searchRequest(snRef, requestType)
+	mutexRequestRefCache.Lock()
+	requestRefCache[cacheKey] = smCallRef
+	mutexRequestRefCache.Unlock()
+	return smCallRef
+}
+
+//searchRequest - searches Hornbill for a request previously imported from the given ServiceNow task reference,
+//optionally of the given request type
+func searchRequest(snRef, requestType string) string {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return ""
+	}
+	searchColumn := snImportConf.Relationships.SearchColumn
+	if searchColumn == "" {
+		searchColumn = "h_external_ref_number"
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", searchColumn)
+	espXmlmc.SetParam("value", snRef)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	if requestType != "" {
+		espXmlmc.OpenElement("searchFilter")
+		espXmlmc.SetParam("column", "h_requesttype")
+		espXmlmc.SetParam("value", requestType)
+		espXmlmc.SetParam("matchType", "exact")
+		espXmlmc.CloseElement("searchFilter")
+	}
+	espXmlmc.SetParam("maxResults", "1")
+
+	XMLRequestSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		logger(4, "Unable to Search for Request ["+snRef+"]: "+xmlmcErr.Error(), false)
+		return ""
+	}
+	var xmlRespon xmlmcRequestSearchResponse
+	err = xml.Unmarshal([]byte(XMLRequestSearch), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to Search for Request ["+snRef+"]: "+err.Error(), false)
+		return ""
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to Search for Request ["+snRef+"]: "+xmlRespon.State.ErrorRet, false)
+		return ""
+	}
+	return xmlRespon.RequestID
+}
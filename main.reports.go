@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var mutexReports = &sync.Mutex{}
+
+//writeReportRow - appends a row to the named CSV report in the log folder, writing the header row when the report is first created
+func writeReportRow(reportName string, header, row []string) {
+	cwd, _ := os.Getwd()
+	appendCSVRow(cwd+"/log/"+reportName+"_"+timeNow+".csv", header, row)
+}
+
+//appendCSVRow - appends a row to a CSV file, creating the file and its folder and writing the header row when the file does not exist
+func appendCSVRow(reportFileName string, header, row []string) {
+	reportName := filepath.Base(reportFileName)
+	mutexReports.Lock()
+	defer mutexReports.Unlock()
+	if err := os.MkdirAll(filepath.Dir(reportFileName), 0777); err != nil {
+		logger(4, "Error Creating Folder for "+reportName+" report: "+err.Error(), false)
+		return
+	}
+	_, err := os.Stat(reportFileName)
+	boolNewReport := os.IsNotExist(err)
+	f, err := os.OpenFile(reportFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		logger(4, "Error Opening "+reportName+" report: "+err.Error(), false)
+		return
+	}
+	defer f.Close()
+	csvWriter := csv.NewWriter(f)
+	if boolNewReport {
+		_ = csvWriter.Write(header)
+	}
+	_ = csvWriter.Write(row)
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		logger(4, "Error Writing "+reportName+" report: "+err.Error(), false)
+	}
+}
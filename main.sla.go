@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- SLA Structs
+type slaConfStruct struct {
+	Import       bool
+	FieldMapping map[string]interface{}
+}
+
+type taskSLAStruct struct {
+	SLAName     string         `db:"sla_name"`
+	SLATarget   string         `db:"sla_target"`
+	Stage       string         `db:"stage"`
+	HasBreached string         `db:"has_breached"`
+	StartTime   sql.NullString `db:"start_time"`
+	EndTime     sql.NullString `db:"end_time"`
+	PlannedEnd  sql.NullString `db:"planned_end_time"`
+}
+
+//processTaskSLAs - reads the task_sla records of a ServiceNow task, and updates the imported request with
+//the response and fix targets, actual timestamps, breach flags and SLA name, as per the class SLA FieldMapping
+func processTaskSLAs(smCallRef, snTaskSysID string) {
+	taskSLAs := getTaskSLAs(snTaskSysID)
+	if len(taskSLAs) == 0 {
+		return
+	}
+	slaMap := make(map[string]interface{})
+	for _, taskSLA := range taskSLAs {
+		slaPrefix := "resolution_"
+		if strings.EqualFold(taskSLA.SLATarget, "response") {
+			slaPrefix = "response_"
+		}
+		slaWithin := "1"
+		if taskSLA.HasBreached == "1" || strings.EqualFold(taskSLA.HasBreached, "true") {
+			slaWithin = "0"
+		}
+		slaMap[slaPrefix+"sla_name"] = taskSLA.SLAName
+		slaMap[slaPrefix+"target"] = getDateTimeValue(taskSLA.PlannedEnd)
+		slaMap[slaPrefix+"start"] = getDateTimeValue(taskSLA.StartTime)
+		slaMap[slaPrefix+"actual"] = getDateTimeValue(taskSLA.EndTime)
+		slaMap[slaPrefix+"stage"] = taskSLA.Stage
+		slaMap[slaPrefix+"within"] = slaWithin
+		slaMap[slaPrefix+"breached"] = "0"
+		if slaWithin == "0" {
+			slaMap[slaPrefix+"breached"] = "1"
+		}
+		if slaMap["sla_name"] == nil || slaPrefix == "resolution_" {
+			slaMap["sla_name"] = taskSLA.SLAName
+		}
+	}
+	if slaMap["response_breached"] == "1" {
+		countSLABreach(mapGenericConf.CallClass + " Response")
+	}
+	if slaMap["resolution_breached"] == "1" {
+		countSLABreach(mapGenericConf.CallClass + " Fix")
+	}
+
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_reference", smCallRef)
+	for k, v := range mapGenericConf.SLA.FieldMapping {
+		strMapping := fmt.Sprintf("%v", v)
+		if strMapping != "" && getFieldValue(strMapping, slaMap) != "" {
+			espXmlmc.SetParam(k, getFieldValue(strMapping, slaMap))
+		}
+	}
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLSLA := espXmlmc.GetParam()
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to update SLA data of request ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		logger(1, XMLSLA, false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to update SLA data of request ["+smCallRef+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to update SLA data of request ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+		logger(1, XMLSLA, false)
+	}
+}
+
+//getTaskSLAs - returns the non-cancelled task_sla records of a ServiceNow task, oldest first
+func getTaskSLAs(snTaskSysID string) []taskSLAStruct {
+	var taskSLAs []taskSLAStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Task SLAs: "+err.Error(), false)
+		return taskSLAs
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Task SLAs: "+err.Error(), false)
+		return taskSLAs
+	}
+	sqlSLAQuery := "SELECT COALESCE(contract_sla.name, '') AS sla_name, COALESCE(contract_sla.target, '') AS sla_target, "
+	sqlSLAQuery += " COALESCE(task_sla.stage, '') AS stage, "
+	sqlSLAQuery += " COALESCE(task_sla.has_breached, '') AS has_breached, task_sla.start_time, "
+	sqlSLAQuery += " task_sla.end_time, task_sla.planned_end_time "
+	sqlSLAQuery += " FROM task_sla "
+	sqlSLAQuery += " JOIN contract_sla ON task_sla.sla = contract_sla.sys_id "
+	sqlSLAQuery += " WHERE task_sla.task = '" + snTaskSysID + "' AND task_sla.stage <> 'cancelled' "
+	sqlSLAQuery += " ORDER BY task_sla.start_time ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Task SLA Query: "+sqlSLAQuery, false)
+	}
+	err = db.Select(&taskSLAs, sqlSLAQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Task SLAs: "+err.Error(), false)
+	}
+	return taskSLAs
+}
+
+//countSLABreach - counts a breached SLA against the given class and SLA type, for the import summary
+func countSLABreach(breachType string) {
+	counters.Lock()
+	if counters.slaBreached == nil {
+		counters.slaBreached = make(map[string]int)
+	}
+	counters.slaBreached[breachType]++
+	counters.Unlock()
+}
+
+//outputSLABreaches - outputs the breached SLA totals per class to the import summary
+func outputSLABreaches() {
+	var breachTypes []string
+	for breachType := range counters.slaBreached {
+		breachTypes = append(breachTypes, breachType)
+	}
+	sort.Strings(breachTypes)
+	for _, breachType := range breachTypes {
+		logger(1, "SLAs Breached ("+breachType+"): "+fmt.Sprintf("%d", counters.slaBreached[breachType]), true)
+	}
+}
+
+//getDateTimeValue - returns a ServiceNow date/time column as a Hornbill date/time string, or an empty string when the column is NULL.
+//Date/time columns are selected without COALESCE, as SQL Server converts an empty string to 1900-01-01, and the mssql driver returns
+//date/times in RFC3339 format, so these are converted to the yyyy-mm-dd hh:mm:ss format of the other drivers
+func getDateTimeValue(dateTime sql.NullString) string {
+	if !dateTime.Valid {
+		return ""
+	}
+	if parsedTime, ok := parseDateTime(dateTime.String); ok {
+		return parsedTime.Format("2006-01-02 15:04:05")
+	}
+	return dateTime.String
+}
+
+//parseDateTime - parses a ServiceNow date/time, in the yyyy-mm-dd hh:mm:ss format, the RFC3339 format returned by the mssql driver,
+//or the format of a time.Time value scanned in to a map and formatted as a string
+func parseDateTime(dateTime string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339Nano, "2006-01-02 15:04:05.999999999 -0700 MST"} {
+		if parsedTime, err := time.Parse(layout, dateTime); err == nil {
+			return parsedTime, true
+		}
+	}
+	return time.Time{}, false
+}
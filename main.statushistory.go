@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	apiLib "github.com/hornbill/goApiLib"
+	"github.com/hornbill/sqlx"
+)
+
+//----- Status History Structs
+type statusHistoryConfStruct struct {
+	Import bool
+	Source string
+	Fields map[string]interface{}
+}
+
+type statusChangeStruct struct {
+	ChangedOn string `db:"changed_on"`
+	OldLabel  string `db:"old_label"`
+	NewLabel  string `db:"new_label"`
+}
+
+type statusHistoryEntryStruct struct {
+	Status    string
+	Timestamp string
+}
+
+//addFullStatusHistory - builds the status history of an imported request from the audited ServiceNow state changes.
+//Falls back to a single record with the current status if no state changes can be mapped
+func addFullStatusHistory(requestRef, requestStatus, dateLogged, snTaskSysID string, espXmlmc *apiLib.XmlmcInstStruct) {
+	statusHistory := getStatusHistory(snTaskSysID, dateLogged)
+	if len(statusHistory) == 0 {
+		addStatusHistory(requestRef, requestStatus, dateLogged, espXmlmc)
+		return
+	}
+	for _, historyEntry := range statusHistory {
+		addStatusHistory(requestRef, historyEntry.Status, historyEntry.Timestamp, espXmlmc)
+	}
+	if statusHistory[len(statusHistory)-1].Status != requestStatus {
+		logger(5, "Status history for ["+requestRef+"] ends in ["+statusHistory[len(statusHistory)-1].Status+"] but request was imported as ["+requestStatus+"]", false)
+	}
+}
+
+//getStatusHistory - returns the time-ordered Hornbill statuses of a ServiceNow task, mapped through the class StatusMapping.
+//The first entry holds the status the task was logged in, consecutive duplicate statuses are collapsed
+func getStatusHistory(snTaskSysID, dateLogged string) []statusHistoryEntryStruct {
+	var statusHistory []statusHistoryEntryStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Status History: "+err.Error(), false)
+		return statusHistory
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Status History: "+err.Error(), false)
+		return statusHistory
+	}
+
+	var statusChanges []statusChangeStruct
+	for fieldName, choiceTable := range mapGenericConf.StatusHistory.Fields {
+		sqlStatusQuery := buildStatusChangeQuery(snTaskSysID, fieldName, fmt.Sprintf("%v", choiceTable))
+		if configDebug {
+			logger(1, "[DATABASE] Status History Query: "+sqlStatusQuery, false)
+		}
+		var fieldChanges []statusChangeStruct
+		err = db.Select(&fieldChanges, sqlStatusQuery)
+		if err != nil {
+			logger(4, " Database Query Error for Status History: "+err.Error(), false)
+			continue
+		}
+		statusChanges = append(statusChanges, fieldChanges...)
+	}
+	sort.SliceStable(statusChanges, func(i, j int) bool {
+		return statusChanges[i].ChangedOn < statusChanges[j].ChangedOn
+	})
+
+	lastStatus := ""
+	addEntry := func(snStatus, timestamp string) {
+		strStatus := getMappedStatus(snStatus)
+		if strStatus == "" || strStatus == lastStatus {
+			return
+		}
+		statusHistory = append(statusHistory, statusHistoryEntryStruct{Status: strStatus, Timestamp: timestamp})
+		lastStatus = strStatus
+	}
+	for i, statusChange := range statusChanges {
+		if i == 0 && statusChange.OldLabel != "" {
+			addEntry(statusChange.OldLabel, dateLogged)
+		}
+		addEntry(statusChange.NewLabel, statusChange.ChangedOn)
+	}
+	return statusHistory
+}
+
+//buildStatusChangeQuery - builds the query to return the audited changes of a single state field, with values resolved to their sys_choice labels
+func buildStatusChangeQuery(snTaskSysID, fieldName, choiceTable string) string {
+	sqlStatusQuery := ""
+	switch mapGenericConf.StatusHistory.Source {
+	case "sys_history_line":
+		sqlStatusQuery = "SELECT sys_history_line.update_time AS changed_on, "
+		sqlStatusQuery += " COALESCE(old_choice.label, '') AS old_label, COALESCE(new_choice.label, '') AS new_label "
+		sqlStatusQuery += " FROM sys_history_line "
+		sqlStatusQuery += " JOIN sys_history_set ON sys_history_line." + quoteIdentifier("set") + " = sys_history_set.sys_id "
+		sqlStatusQuery += " LEFT JOIN sys_choice old_choice ON old_choice.name = '" + choiceTable + "' AND old_choice.element = sys_history_line.field AND old_choice.value = sys_history_line.old_value "
+		sqlStatusQuery += " LEFT JOIN sys_choice new_choice ON new_choice.name = '" + choiceTable + "' AND new_choice.element = sys_history_line.field AND new_choice.value = sys_history_line.new_value "
+		sqlStatusQuery += " WHERE sys_history_set.id = '" + snTaskSysID + "' AND sys_history_line.field = '" + fieldName + "'"
+	default:
+		sqlStatusQuery = "SELECT sys_audit.sys_created_on AS changed_on, "
+		sqlStatusQuery += " COALESCE(old_choice.label, '') AS old_label, COALESCE(new_choice.label, '') AS new_label "
+		sqlStatusQuery += " FROM sys_audit "
+		sqlStatusQuery += " LEFT JOIN sys_choice old_choice ON old_choice.name = '" + choiceTable + "' AND old_choice.element = sys_audit.fieldname AND old_choice.value = sys_audit.oldvalue "
+		sqlStatusQuery += " LEFT JOIN sys_choice new_choice ON new_choice.name = '" + choiceTable + "' AND new_choice.element = sys_audit.fieldname AND new_choice.value = sys_audit.newvalue "
+		sqlStatusQuery += " WHERE sys_audit.documentkey = '" + snTaskSysID + "' AND sys_audit.fieldname = '" + fieldName + "'"
+	}
+	return sqlStatusQuery
+}
+
+//getMappedStatus - maps a ServiceNow status label to a Service Manager status through the class StatusMapping
+func getMappedStatus(snStatus string) string {
+	if mapGenericConf.StatusMapping[snStatus] == nil {
+		if configDebug {
+			logger(1, "Status ["+snStatus+"] is not in StatusMapping and will not be added to the status history", false)
+		}
+		return ""
+	}
+	return fmt.Sprintf("%s", mapGenericConf.StatusMapping[snStatus])
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Survey Structs
+type surveysConfStruct struct {
+	Import        bool
+	MetricType    string
+	RatingMetric  string
+	CommentMetric string
+	RatingScale   ratingScaleConfStruct
+}
+
+type ratingScaleConfStruct struct {
+	SourceMin float64
+	SourceMax float64
+	TargetMin float64
+	TargetMax float64
+	Mapping   map[string]interface{}
+}
+
+type surveyResultStruct struct {
+	InstanceID     string         `db:"instance_id"`
+	SurveyRef      string         `db:"survey_ref"`
+	TaskRef        string         `db:"task_ref"`
+	TakenOn        sql.NullString `db:"taken_on"`
+	MetricName     string         `db:"metric_name"`
+	MetricDataType string         `db:"metric_datatype"`
+	ActualValue    float64        `db:"actual_value"`
+	StringValue    string         `db:"string_value"`
+}
+
+type xmlmcFeedbackRatingResponse struct {
+	MethodResult   string      `xml:"status,attr"`
+	FeedbackRating string      `xml:"params>rowData>row>h_feedback_rating"`
+	State          stateStruct `xml:"state"`
+}
+
+type surveyResponseStruct struct {
+	SurveyRef string
+	TaskRef   string
+	TakenOn   string
+	Rating    string
+	Comments  []string
+}
+
+//processSurveys - imports the completed ServiceNow survey responses as the feedback rating and comments of their imported requests,
+//from this run or a previous run of the import, reporting the responses whose task was not imported
+func processSurveys() {
+	if !snImportConf.Surveys.Import {
+		return
+	}
+	surveyResponses, surveyOrder := getSurveyResponses()
+	//Only the most recent response of each task is imported
+	latestResponses := make(map[string]string)
+	for _, instanceID := range surveyOrder {
+		latestResponses[surveyResponses[instanceID].TaskRef] = instanceID
+	}
+	for _, instanceID := range surveyOrder {
+		surveyResponse := surveyResponses[instanceID]
+		if latestResponses[surveyResponse.TaskRef] != instanceID {
+			continue
+		}
+		smCallRef := getSMRequestRef(surveyResponse.TaskRef)
+		if smCallRef == "" {
+			logger(5, "Survey ["+surveyResponse.SurveyRef+"] not imported, as its task ["+surveyResponse.TaskRef+"] was not imported", false)
+			writeReportRow("SN_Unimported_Surveys", []string{"Survey", "ServiceNow Task", "Taken On", "Rating"},
+				[]string{surveyResponse.SurveyRef, surveyResponse.TaskRef, surveyResponse.TakenOn, surveyResponse.Rating})
+			continue
+		}
+		addRequestFeedback(smCallRef, surveyResponse)
+	}
+}
+
+//getSurveyResponses - returns the completed survey responses raised against ServiceNow tasks, keyed by assessment instance,
+//along with the order the responses were taken in
+func getSurveyResponses() (map[string]*surveyResponseStruct, []string) {
+	surveyResponses := make(map[string]*surveyResponseStruct)
+	var surveyOrder []string
+	var surveyResults []surveyResultStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Surveys: "+err.Error(), false)
+		return surveyResponses, surveyOrder
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Surveys: "+err.Error(), false)
+		return surveyResponses, surveyOrder
+	}
+	sqlSurveyQuery := "SELECT asmt_assessment_instance.sys_id AS instance_id, COALESCE(asmt_assessment_instance.number, '') AS survey_ref, "
+	sqlSurveyQuery += " task.number AS task_ref, asmt_assessment_instance.taken_on, "
+	sqlSurveyQuery += " COALESCE(asmt_metric.name, '') AS metric_name, COALESCE(asmt_metric.datatype, '') AS metric_datatype, "
+	sqlSurveyQuery += " COALESCE(asmt_metric_result.actual_value, 0) AS actual_value, COALESCE(asmt_metric_result.string_value, '') AS string_value "
+	sqlSurveyQuery += " FROM asmt_assessment_instance "
+	sqlSurveyQuery += " JOIN task ON asmt_assessment_instance.trigger_id = task.sys_id "
+	sqlSurveyQuery += " JOIN asmt_metric_result ON asmt_metric_result.instance = asmt_assessment_instance.sys_id "
+	sqlSurveyQuery += " JOIN asmt_metric ON asmt_metric_result.metric = asmt_metric.sys_id "
+	if snImportConf.Surveys.MetricType != "" {
+		sqlSurveyQuery += " JOIN asmt_metric_type ON asmt_assessment_instance.metric_type = asmt_metric_type.sys_id "
+	}
+	sqlSurveyQuery += " WHERE asmt_assessment_instance.state = 'complete' "
+	if snImportConf.Surveys.MetricType != "" {
+		sqlSurveyQuery += " AND asmt_metric_type.name = '" + strings.Replace(snImportConf.Surveys.MetricType, "'", "''", -1) + "' "
+	}
+	sqlSurveyQuery += " ORDER BY asmt_assessment_instance.taken_on ASC, asmt_metric." + quoteIdentifier("order") + " ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Survey Query: "+sqlSurveyQuery, false)
+	}
+	err = db.Select(&surveyResults, sqlSurveyQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Surveys: "+err.Error(), false)
+		return surveyResponses, surveyOrder
+	}
+
+	for _, surveyResult := range surveyResults {
+		surveyResponse, ok := surveyResponses[surveyResult.InstanceID]
+		if !ok {
+			surveyResponse = &surveyResponseStruct{
+				SurveyRef: surveyResult.SurveyRef,
+				TaskRef:   surveyResult.TaskRef,
+				TakenOn:   getDateTimeValue(surveyResult.TakenOn),
+			}
+			surveyResponses[surveyResult.InstanceID] = surveyResponse
+			surveyOrder = append(surveyOrder, surveyResult.InstanceID)
+		}
+		if isSurveyRatingMetric(surveyResult) {
+			if surveyResponse.Rating == "" {
+				surveyResponse.Rating = getSurveyRating(surveyResult)
+			}
+			continue
+		}
+		if isSurveyCommentMetric(surveyResult) && strings.TrimSpace(surveyResult.StringValue) != "" {
+			strComment := surveyResult.StringValue
+			if snImportConf.Surveys.CommentMetric == "" {
+				strComment = surveyResult.MetricName + ": " + strComment
+			}
+			surveyResponse.Comments = append(surveyResponse.Comments, strComment)
+		}
+	}
+	return surveyResponses, surveyOrder
+}
+
+//isSurveyRatingMetric - returns true if the survey result is the rating, being the configured RatingMetric,
+//or any scale metric where no RatingMetric is configured
+func isSurveyRatingMetric(surveyResult surveyResultStruct) bool {
+	if snImportConf.Surveys.RatingMetric != "" {
+		return strings.EqualFold(surveyResult.MetricName, snImportConf.Surveys.RatingMetric)
+	}
+	return strings.EqualFold(surveyResult.MetricDataType, "scale") || strings.EqualFold(surveyResult.MetricDataType, "numericscale")
+}
+
+//isSurveyCommentMetric - returns true if the survey result should be included in the feedback comments, being the configured CommentMetric,
+//or any string metric where no CommentMetric is configured
+func isSurveyCommentMetric(surveyResult surveyResultStruct) bool {
+	if snImportConf.Surveys.CommentMetric != "" {
+		return strings.EqualFold(surveyResult.MetricName, snImportConf.Surveys.CommentMetric)
+	}
+	return strings.EqualFold(surveyResult.MetricDataType, "string")
+}
+
+//getSurveyRating - converts a ServiceNow survey rating to the Hornbill feedback rating scale, using the RatingScale Mapping
+//where the value is mapped, or a linear conversion from the source to the target scale
+func getSurveyRating(surveyResult surveyResultStruct) string {
+	ratingScale := snImportConf.Surveys.RatingScale
+	strSourceValue := strconv.FormatFloat(surveyResult.ActualValue, 'f', -1, 64)
+	for _, snValue := range []string{strSourceValue, surveyResult.StringValue} {
+		if mappedRating, ok := ratingScale.Mapping[snValue]; ok && snValue != "" {
+			return fmt.Sprintf("%v", mappedRating)
+		}
+	}
+	if ratingScale.SourceMax <= ratingScale.SourceMin || ratingScale.TargetMax <= ratingScale.TargetMin {
+		return strSourceValue
+	}
+	floatRating := ratingScale.TargetMin + (surveyResult.ActualValue-ratingScale.SourceMin)*(ratingScale.TargetMax-ratingScale.TargetMin)/(ratingScale.SourceMax-ratingScale.SourceMin)
+	floatRating = math.Max(ratingScale.TargetMin, math.Min(ratingScale.TargetMax, math.Round(floatRating)))
+	return strconv.FormatFloat(floatRating, 'f', -1, 64)
+}
+
+//addRequestFeedback - updates an imported request with the feedback rating and comments of a survey response, where the request
+//does not already have a feedback rating, so reruns of the import do not rewrite the feedback of requests from previous runs
+func addRequestFeedback(smCallRef string, surveyResponse *surveyResponseStruct) {
+	if surveyResponse.Rating == "" && len(surveyResponse.Comments) == 0 {
+		return
+	}
+	strRating, ok := getRequestFeedbackRating(smCallRef)
+	if !ok {
+		return
+	}
+	if strRating != "" && strRating != "0" {
+		if configDebug {
+			logger(1, "Survey ["+surveyResponse.SurveyRef+"] not imported, as request ["+smCallRef+"] already has a feedback rating of ["+strRating+"]", false)
+		}
+		return
+	}
+	if configDryRun {
+		logger(3, "[DRYRUN] Survey ["+surveyResponse.SurveyRef+"] would set the feedback of request ["+smCallRef+"] to rating ["+surveyResponse.Rating+"], comments ["+strings.Join(surveyResponse.Comments, " / ")+"]", false)
+		return
+	}
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_reference", smCallRef)
+	if surveyResponse.Rating != "" {
+		espXmlmc.SetParam("h_feedback_rating", surveyResponse.Rating)
+	}
+	if len(surveyResponse.Comments) > 0 {
+		espXmlmc.SetParam("h_feedback_comments", strings.Join(surveyResponse.Comments, "\n\n"))
+	}
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLFeedback := espXmlmc.GetParam()
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to add Survey ["+surveyResponse.SurveyRef+"] feedback to request ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		logger(1, XMLFeedback, false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to add Survey ["+surveyResponse.SurveyRef+"] feedback to request ["+smCallRef+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to add Survey ["+surveyResponse.SurveyRef+"] feedback to request ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+		logger(1, XMLFeedback, false)
+		return
+	}
+	counters.Lock()
+	counters.surveys++
+	counters.Unlock()
+}
+
+//getRequestFeedbackRating - returns the current feedback rating of a request, and false where the request could not be read
+func getRequestFeedbackRating(smCallRef string) (string, bool) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return "", false
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", "h_pk_reference")
+	espXmlmc.SetParam("value", smCallRef)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", "1")
+	XMLRequest, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		logger(4, "Unable to read the feedback rating of request ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		return "", false
+	}
+	var xmlRespon xmlmcFeedbackRatingResponse
+	err = xml.Unmarshal([]byte(XMLRequest), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read the feedback rating of request ["+smCallRef+"]: "+err.Error(), false)
+		return "", false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to read the feedback rating of request ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+		return "", false
+	}
+	return xmlRespon.FeedbackRating, true
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Time Worked Structs
+type timeWorkedConfStruct struct {
+	Import       bool
+	Application  string
+	Entity       string
+	FieldMapping map[string]interface{}
+}
+
+type timeWorkedStruct struct {
+	UserName      string `db:"user_name"`
+	TimeInSeconds int    `db:"time_in_seconds"`
+	Comments      string `db:"comments"`
+	Category      string `db:"category"`
+	CreatedOn     string `db:"sys_created_on"`
+}
+
+//processTimeWorked - imports the task_time_worked records of a ServiceNow task as time entries against the imported request,
+//as per the class TimeWorked FieldMapping
+func processTimeWorked(smCallRef, snCallRef, snTaskSysID string) {
+	for _, timeWorked := range getTimeWorked(snTaskSysID) {
+		strUserID := ""
+		if timeWorked.UserName != "" {
+			analystIsInCache, _, strAnalystID := recordInCache(timeWorked.UserName, "Analyst")
+			if analystIsInCache {
+				strUserID = strAnalystID
+			}
+		}
+		if strUserID == "" {
+			logger(5, "Time worked by ["+timeWorked.UserName+"] on ["+snCallRef+"] not imported, as the user could not be resolved to a Hornbill analyst", false)
+			continue
+		}
+		if addTimeWorked(smCallRef, strUserID, timeWorked) {
+			countTimeWorked(smCallRef, timeWorked.TimeInSeconds)
+		}
+	}
+}
+
+//getTimeWorked - returns the task_time_worked records of a ServiceNow task, oldest first
+func getTimeWorked(snTaskSysID string) []timeWorkedStruct {
+	var timeWorkedRows []timeWorkedStruct
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Time Worked: "+err.Error(), false)
+		return timeWorkedRows
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Time Worked: "+err.Error(), false)
+		return timeWorkedRows
+	}
+	sqlTimeQuery := "SELECT COALESCE(sys_user.user_name, '') AS user_name, COALESCE(task_time_worked.time_in_seconds, 0) AS time_in_seconds, "
+	sqlTimeQuery += " COALESCE(task_time_worked.comments, '') AS comments, COALESCE(task_time_worked.category, '') AS category, "
+	sqlTimeQuery += " task_time_worked.sys_created_on "
+	sqlTimeQuery += " FROM task_time_worked "
+	sqlTimeQuery += " LEFT JOIN sys_user ON task_time_worked." + quoteIdentifier("user") + " = sys_user.sys_id "
+	sqlTimeQuery += " WHERE task_time_worked.task = '" + snTaskSysID + "'"
+	sqlTimeQuery += " ORDER BY task_time_worked.sys_created_on ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Time Worked Query: "+sqlTimeQuery, false)
+	}
+	err = db.Select(&timeWorkedRows, sqlTimeQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Time Worked: "+err.Error(), false)
+	}
+	return timeWorkedRows
+}
+
+//addTimeWorked - adds a single time worked record as a time entry against an imported request
+func addTimeWorked(smCallRef, strUserID string, timeWorked timeWorkedStruct) bool {
+	//The entry ends when it was recorded in ServiceNow, and starts the worked duration before
+	strEndTime := timeWorked.CreatedOn
+	strStartTime := timeWorked.CreatedOn
+	if endTime, ok := parseDateTime(timeWorked.CreatedOn); ok {
+		strEndTime = endTime.Format("2006-01-02 15:04:05")
+		strStartTime = endTime.Add(-time.Duration(timeWorked.TimeInSeconds) * time.Second).Format("2006-01-02 15:04:05")
+	} else {
+		logger(5, "Unable to parse the date ["+timeWorked.CreatedOn+"] of time worked on ["+smCallRef+"], so the start time of the entry is the same as its end time", false)
+	}
+	timeMap := map[string]interface{}{
+		"user_id":          strUserID,
+		"start_time":       strStartTime,
+		"end_time":         strEndTime,
+		"duration_seconds": strconv.Itoa(timeWorked.TimeInSeconds),
+		"duration_minutes": strconv.Itoa(timeWorked.TimeInSeconds / 60),
+		"comments":         timeWorked.Comments,
+		"category":         timeWorked.Category,
+		"request_ref":      smCallRef,
+		"request_urn":      "urn:sys:entity:" + appServiceManager + ":Requests:" + smCallRef,
+	}
+
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return false
+	}
+	espXmlmc.SetParam("application", mapGenericConf.TimeWorked.Application)
+	espXmlmc.SetParam("entity", mapGenericConf.TimeWorked.Entity)
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	for k, v := range mapGenericConf.TimeWorked.FieldMapping {
+		strMapping := fmt.Sprintf("%v", v)
+		if strMapping != "" && getFieldValue(strMapping, timeMap) != "" {
+			espXmlmc.SetParam(k, getFieldValue(strMapping, timeMap))
+		}
+	}
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLTime, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to add Time Worked to ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLTime), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to add Time Worked to ["+smCallRef+"]: "+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to add Time Worked to ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
+
+//countTimeWorked - adds an imported time entry to the time worked totals of its request, for the import summary
+func countTimeWorked(smCallRef string, timeInSeconds int) {
+	counters.Lock()
+	if counters.timeWorked == nil {
+		counters.timeWorked = make(map[string]int)
+	}
+	counters.timeWorked[smCallRef] += timeInSeconds
+	counters.timeEntries++
+	counters.Unlock()
+}
+
+//outputTimeWorked - writes the per-request time worked totals to the SN_Time_Worked report, and outputs the overall total to the import summary
+func outputTimeWorked() {
+	if counters.timeEntries == 0 {
+		return
+	}
+	var requestRefs []string
+	totalSeconds := 0
+	for requestRef, requestSeconds := range counters.timeWorked {
+		requestRefs = append(requestRefs, requestRef)
+		totalSeconds += requestSeconds
+	}
+	sort.Strings(requestRefs)
+	for _, requestRef := range requestRefs {
+		requestSeconds := counters.timeWorked[requestRef]
+		writeReportRow("SN_Time_Worked", []string{"Hornbill Request", "Time Worked Seconds", "Time Worked"},
+			[]string{requestRef, strconv.Itoa(requestSeconds), fmt.Sprintf("%v", time.Duration(requestSeconds)*time.Second)})
+	}
+	logger(1, "Time Entries Imported: "+fmt.Sprintf("%d", counters.timeEntries)+" against "+fmt.Sprintf("%d", len(requestRefs))+" requests, totalling "+fmt.Sprintf("%v", time.Duration(totalSeconds)*time.Second), true)
+}
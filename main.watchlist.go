@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hornbill/sqlx"
+)
+
+//----- Watch List Structs
+type watchListConfStruct struct {
+	Import         bool
+	Fields         map[string]interface{}
+	ExternalEmails string
+}
+
+type watchListUserStruct struct {
+	UserName string `db:"user_name"`
+	Email    string `db:"email"`
+}
+
+type xmlmcContactSearchResponse struct {
+	MethodResult string      `xml:"status,attr"`
+	ContactID    string      `xml:"params>rowData>row>h_pk_id"`
+	State        stateStruct `xml:"state"`
+}
+
+type xmlmcContactAddResponse struct {
+	MethodResult string      `xml:"status,attr"`
+	ContactID    string      `xml:"params>primaryEntityData>record>h_pk_id"`
+	State        stateStruct `xml:"state"`
+}
+
+var (
+	contactCache      = make(map[string]string)
+	contactLocks      = make(map[string]*sync.Mutex)
+	mutexContactCache = &sync.Mutex{}
+)
+
+//processWatchLists - adds the users and contacts held in the watch list fields of a ServiceNow task as connections to the imported request
+func processWatchLists(smCallRef, snCallRef, snTaskSysID string) {
+	db, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, " [DATABASE] Database Connection Error for Watch Lists: "+err.Error(), false)
+		return
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Watch Lists: "+err.Error(), false)
+		return
+	}
+	var watchFields []string
+	for watchField := range mapGenericConf.WatchList.Fields {
+		watchFields = append(watchFields, watchField)
+	}
+	sort.Strings(watchFields)
+	connectionsAdded := make(map[string]bool)
+	for _, watchField := range watchFields {
+		connectionType := fmt.Sprintf("%v", mapGenericConf.WatchList.Fields[watchField])
+		sqlWatchQuery := "SELECT COALESCE(" + watchField + ", '') FROM task WHERE sys_id = '" + snTaskSysID + "'"
+		if configDebug {
+			logger(1, "[DATABASE] Watch List Query: "+sqlWatchQuery, false)
+		}
+		var watchList string
+		err = db.Get(&watchList, sqlWatchQuery)
+		if err != nil {
+			logger(4, " Database Query Error for Watch List ["+watchField+"]: "+err.Error(), false)
+			continue
+		}
+		for _, watchEntry := range strings.Split(watchList, ",") {
+			watchEntry = strings.TrimSpace(watchEntry)
+			if watchEntry == "" {
+				continue
+			}
+			entityType, entityID := resolveWatchListEntry(db, watchEntry)
+			if entityID == "" {
+				logger(5, "Watch list entry ["+watchEntry+"] of ["+snCallRef+"] could not be resolved to a Hornbill user or contact", false)
+				continue
+			}
+			if connectionsAdded[entityType+":"+entityID] {
+				continue
+			}
+			connectionsAdded[entityType+":"+entityID] = true
+			addRequestConnection(smCallRef, entityType, entityID, connectionType)
+		}
+	}
+}
+
+//resolveWatchListEntry - resolves a watch list sys_id or email address to a Hornbill user or contact, returning the entity type and ID.
+//External email addresses are matched to, or created as, contacts where ExternalEmails is set to contact
+func resolveWatchListEntry(db *sqlx.DB, watchEntry string) (string, string) {
+	var watchUsers []watchListUserStruct
+	sqlUserQuery := "SELECT COALESCE(user_name, '') AS user_name, COALESCE(email, '') AS email FROM sys_user "
+	if strings.Contains(watchEntry, "@") {
+		sqlUserQuery += " WHERE email = '" + strings.Replace(watchEntry, "'", "''", -1) + "'"
+	} else {
+		sqlUserQuery += " WHERE sys_id = '" + strings.Replace(watchEntry, "'", "''", -1) + "'"
+	}
+	err := db.Select(&watchUsers, sqlUserQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Watch List User ["+watchEntry+"]: "+err.Error(), false)
+	}
+	for _, watchUser := range watchUsers {
+		if watchUser.UserName == "" {
+			continue
+		}
+		if analystIsInCache, _, strAnalystID := recordInCache(watchUser.UserName, "Analyst"); analystIsInCache {
+			return "user", strAnalystID
+		}
+		if doesCustomerExist(watchUser.UserName) {
+			_, _, strCustomerID := recordInCache(watchUser.UserName, "Customer")
+			if snImportConf.CustomerType == "0" {
+				return "user", strCustomerID
+			}
+			return "contact", strCustomerID
+		}
+	}
+	if !strings.Contains(watchEntry, "@") || !strings.EqualFold(mapGenericConf.WatchList.ExternalEmails, "contact") {
+		return "", ""
+	}
+	return "contact", getContactID(watchEntry)
+}
+
+//getContactID - returns the ID of the Hornbill contact with the given email address, creating the contact where the search succeeds
+//and finds no contact. Lookups are locked per email address, so lookups of the same address wait for each other and a contact is never
+//added twice, while lookups of other addresses are not held up by the API calls. Failed lookups are not cached, so are retried
+func getContactID(strEmail string) string {
+	emailKey := strings.ToLower(strEmail)
+	mutexContactCache.Lock()
+	contactLock, ok := contactLocks[emailKey]
+	if !ok {
+		contactLock = &sync.Mutex{}
+		contactLocks[emailKey] = contactLock
+	}
+	mutexContactCache.Unlock()
+
+	contactLock.Lock()
+	defer contactLock.Unlock()
+	mutexContactCache.Lock()
+	contactID, ok := contactCache[emailKey]
+	mutexContactCache.Unlock()
+	if ok {
+		return contactID
+	}
+	contactID, found, err := searchContact(strEmail)
+	if err != nil {
+		logger(4, "Unable to Search for Contact ["+strEmail+"]: "+err.Error(), false)
+		return ""
+	}
+	if !found {
+		contactID = addContact(strEmail)
+		if contactID == "" {
+			return ""
+		}
+	}
+	mutexContactCache.Lock()
+	contactCache[emailKey] = contactID
+	mutexContactCache.Unlock()
+	return contactID
+}
+
+//searchContact - searches Hornbill for a contact with the given email address, returning the contact ID, whether a contact was found,
+//and an error where the search could not be completed
+func searchContact(strEmail string) (string, bool, error) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return "", false, err
+	}
+	espXmlmc.SetParam("application", "com.hornbill.core")
+	espXmlmc.SetParam("entity", "Contact")
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", "h_email_1")
+	espXmlmc.SetParam("value", strEmail)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", "1")
+	XMLContactSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		return "", false, xmlmcErr
+	}
+	var xmlRespon xmlmcContactSearchResponse
+	err = xml.Unmarshal([]byte(XMLContactSearch), &xmlRespon)
+	if err != nil {
+		return "", false, err
+	}
+	if xmlRespon.MethodResult != "ok" {
+		return "", false, errors.New(xmlRespon.State.ErrorRet)
+	}
+	return xmlRespon.ContactID, xmlRespon.ContactID != "", nil
+}
+
+//addContact - creates a Hornbill contact for an external watch list email address
+func addContact(strEmail string) string {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return ""
+	}
+	strFirstName := strEmail
+	if atIndex := strings.Index(strEmail, "@"); atIndex > 0 {
+		strFirstName = strEmail[:atIndex]
+	}
+	espXmlmc.SetParam("application", "com.hornbill.core")
+	espXmlmc.SetParam("entity", "Contact")
+	espXmlmc.SetParam("returnModifiedData", "true")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_firstname", strFirstName)
+	espXmlmc.SetParam("h_lastname", "")
+	espXmlmc.SetParam("h_email_1", strEmail)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLContact, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to add Contact ["+strEmail+"]: "+xmlmcErr.Error(), false)
+		return ""
+	}
+	var xmlRespon xmlmcContactAddResponse
+	err = xml.Unmarshal([]byte(XMLContact), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to add Contact ["+strEmail+"]: "+err.Error(), false)
+		return ""
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to add Contact ["+strEmail+"]: "+xmlRespon.State.ErrorRet, false)
+		return ""
+	}
+	logger(3, "[CONTACT] Contact ["+xmlRespon.ContactID+"] created for watch list email address ["+strEmail+"]", false)
+	return xmlRespon.ContactID
+}
+
+//addRequestConnection - adds a user or contact as a connection to an imported request
+func addRequestConnection(smCallRef, entityType, entityID, connectionType string) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "RequestConnections")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_request_id", smCallRef)
+	espXmlmc.SetParam("h_entity_type", entityType)
+	espXmlmc.SetParam("h_entity_id", entityID)
+	if connectionType != "" {
+		espXmlmc.SetParam("h_connection_type", connectionType)
+	}
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLConnection, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to add Connection ["+entityID+"] to ["+smCallRef+"]: "+xmlmcErr.Error(), false)
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLConnection), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to add Connection ["+entityID+"] to ["+smCallRef+"]: "+err.Error(), false)
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to add Connection ["+entityID+"] to ["+smCallRef+"]: "+xmlRespon.State.ErrorRet, false)
+	}
+}
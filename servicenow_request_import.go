@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
 	"html"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -40,7 +39,6 @@ var (
 	appDBDriver            string
 	arrCallsLogged         = make(map[string]reqRelStruct)
 	arrCallDetailsMaps     = make([]map[string]interface{}, 0)
-	arrActivityDetailsMaps = make([]map[string]interface{}, 0)
 	boolConfLoaded         bool
 	configFileName         string
 	configZone             string
@@ -53,7 +51,6 @@ var (
 	pageSize               int
 	counters               counterTypeStruct
 	mapGenericConf         snCallConfStruct
-	mapActivityConf        snActivityConfStruct
 	analysts               []analystListStruct
 	categories             []categoryListStruct
 	closeCategories        []categoryListStruct
@@ -89,9 +86,16 @@ var (
 // ----- Structures -----
 type counterTypeStruct struct {
 	sync.Mutex
-	created        int
-	createdSkipped int
-	filesAttached  int
+	created            int
+	createdSkipped     int
+	filesAttached      int
+	analystsUnresolved int
+	slaBreached        map[string]int
+	timeWorked         map[string]int
+	timeEntries        int
+	surveys            int
+	attachmentOutcomes map[string]int
+	filesExported      int
 }
 
 //----- Config Data Structs
@@ -107,10 +111,16 @@ type snImportConfStruct struct {
 	ConfProblem               snCallConfStruct
 	ConfKnownError            snCallConfStruct
 	ConfRelease               snCallConfStruct
-	ConfActivities            snActivityConfStruct
+	ConfActivities            activitiesConfStruct
+	ChildTasks                childTasksConfStruct
+	Surveys                   surveysConfStruct
+	Attachments               attachmentsConfStruct
+	HistoricUpdates           historicUpdateConfStruct
+	Relationships             relationshipConfStruct
 	TeamMapping               map[string]interface{}
 	CategoryMapping           map[string]interface{}
 	ResolutionCategoryMapping map[string]interface{}
+	CompanyMapping            map[string]interface{}
 }
 type hbConfStruct struct {
 	APIKey     string
@@ -139,21 +149,62 @@ type snCallConfStruct struct {
 	StatusMapping          map[string]interface{}
 	PriorityMapping        map[string]interface{}
 	ServiceMapping         map[string]interface{}
+	AnalystFallback        map[string]analystFallbackStruct
+	StatusHistory          statusHistoryConfStruct
+	CatalogHierarchy       catalogHierarchyConfStruct
+	CatalogVariables       catalogVariablesConfStruct
+	SLA                    slaConfStruct
+	ChangeFields           changeFieldsConfStruct
+	KnownErrorLinks        knownErrorLinksConfStruct
+	AssetLinks             assetLinkConfStruct
+	Organisation           organisationConfStruct
+	WatchList              watchListConfStruct
+	TimeWorked             timeWorkedConfStruct
+	Emails                 emailConfStruct
+}
+
+//analystFallbackStruct - what to do with an analyst field when the ServiceNow analyst cannot be resolved
+type analystFallbackStruct struct {
+	Method         string
+	DefaultAnalyst string
+}
+
+//historicUpdateConfStruct - controls how ServiceNow journal entries are imported as Historic Updates
+type historicUpdateConfStruct struct {
+	ResolveAuthors          bool
+	TeamFromAssignmentGroup bool
+	Elements                map[string]journalElementStruct
+	TimelineHeader          string
+}
+
+//journalElementStruct - how entries of a single sys_journal_field element are imported
+type journalElementStruct struct {
+	Label      string
+	Visibility string
+	Target     string
 }
 
 type snActivityConfStruct struct {
-	Import       bool
-	SQLStatement map[string]interface{}
-	Category     string
-	ParentRef    string
-	Title        string
-	Description  string
-	StartDate    string
-	DueDate      string
-	AssignTo     string
-	Status       string
-	Decision     string
-	Reason       string
+	Name           string
+	Import         bool
+	SQLStatement   map[string]interface{}
+	Category       string
+	ParentRef      string
+	Title          string
+	Description    string
+	StartDate      string
+	DueDate        string
+	AssignTo       string
+	AssignToTeam   string
+	AppendJournal  bool
+	Status         string
+	Decision       string
+	Reason         string
+	CreatedDate    string
+	CompletedDate  string
+	CompletedBy    string
+	StatusMapping  map[string]interface{}
+	OutcomeMapping map[string]interface{}
 }
 
 type xmlmcResponse struct {
@@ -315,6 +366,13 @@ type reqRelStruct struct {
 	SMCallRef     string
 }
 
+//----- Historic Update Structs
+type assignmentGroupChangeStruct struct {
+	ChangedOn string `db:"sys_created_on"`
+	OldGroup  string `db:"old_group"`
+	NewGroup  string `db:"new_group"`
+}
+
 //----- File Attachment Structs
 type xmlmcAttachmentResponse struct {
 	MethodResult    string      `xml:"status,attr"`
@@ -324,16 +382,18 @@ type xmlmcAttachmentResponse struct {
 
 //----- File Attachment Struct
 type fileAssocStruct struct {
-	ContentType string  `db:"content_type"`
-	FileGUID    string  `db:"sys_id"`
-	SizeU       float64 `db:"size_bytes"`
-	SizeC       float64 `db:"size_compressed"`
-	FileName    string  `db:"file_name"`
-	AddedBy     string  `db:"sys_created_by"`
-	TimeAdded   string  `db:"sys_created_on"`
-	Pieces      int     `db:"pieces"`
-	FileDataB64 string
-	SMCallRef   string
+	ContentType    string  `db:"content_type"`
+	FileGUID       string  `db:"sys_id"`
+	SizeU          float64 `db:"size_bytes"`
+	SizeC          float64 `db:"size_compressed"`
+	FileName       string  `db:"file_name"`
+	AddedBy        string  `db:"sys_created_by"`
+	TimeAdded      string  `db:"sys_created_on"`
+	Pieces         int     `db:"pieces"`
+	TableName      string  `db:"table_name"`
+	TableSysID     string  `db:"table_sys_id"`
+	ServerFileName string
+	SMCallRef      string
 }
 
 //----- File Attachment Data Struct
@@ -441,6 +501,9 @@ func main() {
 	if mapGenericConf.Import {
 		reqPrefix = getRequestPrefix("SR")
 		processCallData()
+		if mapGenericConf.CatalogHierarchy.Enabled {
+			processCatalogTasks()
+		}
 	}
 	//Process Change Requests
 	mapGenericConf = snImportConf.ConfChangeRequest
@@ -473,18 +536,32 @@ func main() {
 		processRequestAttachments()
 
 		//Now process activities
-		mapActivityConf = snImportConf.ConfActivities
-		if mapActivityConf.Import {
-			processActivities()
-		}
+		processActivityDefinitions()
+		processChildTasks()
 		//Now process associations
-		processCallAssociations()
+		if snImportConf.Relationships.Import {
+			processRelationships()
+		} else {
+			processCallAssociations()
+		}
 	}
+	//Now process survey feedback, which can be against requests imported in previous runs
+	processSurveys()
 
 	//-- End output
 	logger(1, "Requests Logged: "+fmt.Sprintf("%d", counters.created), true)
 	logger(1, "Requests Skipped: "+fmt.Sprintf("%d", counters.createdSkipped), true)
 	logger(1, "Files Attached: "+fmt.Sprintf("%d", counters.filesAttached), true)
+	if getAttachmentSink() != "hornbill" {
+		logger(1, "Files Exported: "+fmt.Sprintf("%d", counters.filesExported), true)
+	}
+	outputAttachmentOutcomes()
+	logger(1, "Analysts Unresolved: "+fmt.Sprintf("%d", counters.analystsUnresolved), true)
+	if snImportConf.Surveys.Import {
+		logger(1, "Survey Responses Imported: "+fmt.Sprintf("%d", counters.surveys), true)
+	}
+	outputSLABreaches()
+	outputTimeWorked()
 	//-- Show Time Takens
 	endTime = time.Since(startTime)
 	logger(1, "Time Taken: "+fmt.Sprintf("%v", endTime), true)
@@ -545,7 +622,7 @@ func processRequestAttachments() {
 	maxGoroutinesGuard := make(chan struct{}, maxGoroutines)
 	for requestID, requestSlice := range arrCallsLogged {
 
-		snCallRef := requestID
+		requestKey := requestID
 		snCallGUID := requestSlice.SNRequestGUID
 		smCallRef := requestSlice.SMCallRef
 
@@ -555,7 +632,7 @@ func processRequestAttachments() {
 			defer wgAttach.Done()
 			time.Sleep(1 * time.Millisecond)
 			//We have Master and Slave calls matched in the SM database
-			processFileAttachments(snCallGUID, snCallRef, smCallRef)
+			processFileAttachments(snCallGUID, requestKey, smCallRef)
 
 			mutexBar.Lock()
 			bar.Increment()
@@ -568,7 +645,10 @@ func processRequestAttachments() {
 	logger(1, "Request Attachments Processing Complete", false)
 }
 
-func processFileAttachments(taskSysID, snCallRef, smCallRef string) {
+//processFileAttachments - imports the sys_attachment records of a ServiceNow record as file attachments against an imported request,
+//recording the outcome of each attachment in the attachment report. The request key is the key of the request in arrCallsLogged
+func processFileAttachments(taskSysID, requestKey, smCallRef string) {
+	snCallRef := getSNCallRef(requestKey)
 	//Connect to the JSON specified DB
 	db, err := sqlx.Open(appDBDriver, connStrAppDB)
 	if err != nil {
@@ -583,8 +663,8 @@ func processFileAttachments(taskSysID, snCallRef, smCallRef string) {
 		return
 	}
 	//build query
-	sqlFileQuery := "SELECT sys_id, file_name, content_type, size_bytes, size_compressed, sys_created_by, sys_created_on, "
-	sqlFileQuery += " (SELECT COUNT(position) FROM sys_attachment_doc WHERE sys_attachment_doc.sys_attachment = sys_attachment.sys_id GROUP BY sys_attachment_doc.sys_attachment ) AS pieces "
+	sqlFileQuery := "SELECT sys_id, file_name, content_type, size_bytes, size_compressed, sys_created_by, sys_created_on, table_name, table_sys_id, "
+	sqlFileQuery += " COALESCE((SELECT COUNT(position) FROM sys_attachment_doc WHERE sys_attachment_doc.sys_attachment = sys_attachment.sys_id GROUP BY sys_attachment_doc.sys_attachment ), 0) AS pieces "
 	sqlFileQuery += " FROM sys_attachment WHERE table_sys_id = '" + taskSysID + "'"
 
 	if configDebug {
@@ -594,94 +674,104 @@ func processFileAttachments(taskSysID, snCallRef, smCallRef string) {
 	}
 
 	//Run Query
-	attachmentRows, err := db.Queryx(sqlFileQuery)
+	var requestAttachments []fileAssocStruct
+	err = db.Select(&requestAttachments, sqlFileQuery)
 	if err != nil {
 		logger(4, " Database Query Error: "+err.Error(), false)
 		return
 	}
 	//-- Iterate through file attachment records returned from SQL query
-	for attachmentRows.Next() {
-		//Scan current file attachment record in to struct
-		var requestAttachment fileAssocStruct
-		err = attachmentRows.StructScan(&requestAttachment)
-		if err != nil {
-			logger(4, " Data Mapping Error: "+err.Error(), false)
-			return
-		}
+	for _, requestAttachment := range requestAttachments {
 		requestAttachment.SMCallRef = smCallRef
+		strOutcome, strDetail := getAttachmentFilterOutcome(requestAttachment)
+		if strOutcome == "" {
+			strOutcome, strDetail = processFileAttachment(db, requestAttachment, requestKey)
+		}
+		recordAttachmentOutcome(requestAttachment, snCallRef, strOutcome, strDetail)
+	}
+}
 
-		//Now go get each of the file chunks for processing
-		sqlFileDataQuery := "SELECT position, length, data "
-		sqlFileDataQuery += " FROM sys_attachment_doc "
-		sqlFileDataQuery += " WHERE sys_attachment = '" + requestAttachment.FileGUID + "'"
-		sqlFileDataQuery += " ORDER BY position ASC"
+//processFileAttachment - streams a single attachment from the attachment Source to the Hornbill instance and attaches it to the
+//imported request, and/or exports it to disk, as per the Attachments Sink, returning the outcome of the attachment and the reason for any
+//failure. The content is decoded and decompressed as it is written, so the file is never held in memory in full regardless of its size
+func processFileAttachment(db *sqlx.DB, requestAttachment fileAssocStruct, requestKey string) (string, string) {
+	snCallRef := getSNCallRef(requestKey)
+	sourceReader, err := openAttachmentContent(db, requestAttachment, snCallRef)
+	if err != nil {
+		return attachmentFailed, "unable to read attachment data: " + err.Error()
+	}
+	defer sourceReader.Close()
 
-		if configDebug {
-			logger(1, "[DATABASE] Request File Attachments Query: "+sqlFileDataQuery, false)
+	var contentReader io.Reader = sourceReader
+	if isAttachmentSourceCompressed() {
+		//Attachment content in to a gzip reader, which decompresses the content as it is read
+		gzipReader, err := gzip.NewReader(sourceReader)
+		if err != nil {
+			return getAttachmentReadOutcome(err)
 		}
+		defer gzipReader.Close()
+		contentReader = gzipReader
+	}
 
-		//Run Query
-		attachmentRowData, err := db.Queryx(sqlFileDataQuery)
+	fileStream := &attachmentStream{reader: contentReader}
+	var fileContent io.Reader = fileStream
+	strSink := getAttachmentSink()
+	var attachmentExport *attachmentExportStruct
+	if strSink != "hornbill" {
+		attachmentExport, err = createAttachmentExport(requestKey, requestAttachment)
 		if err != nil {
-			logger(4, " Database Query Error: "+err.Error(), false)
+			return attachmentFailed, "unable to create export file: " + err.Error()
 		}
-
-		boolBreakRowLoop := false
-		var attachSlice []byte
-
-		//-- Iterate through file attachment records returned from SQL query:
-		for attachmentRowData.Next() {
-			var rowAttachmentData fileAssocDataStruct
-			err = attachmentRowData.StructScan(&rowAttachmentData)
-			if err != nil {
-				logger(4, " Data Mapping Error: "+err.Error(), false)
-				boolBreakRowLoop = true
-				break
-			}
-			//Decode Base64 string in to byte slice
-			decoded, err := base64.StdEncoding.DecodeString(rowAttachmentData.Data)
-			if err != nil {
-				logger(4, " Error Decoding Base64: "+err.Error(), false)
-				boolBreakRowLoop = true
-				break
-			}
-			attachSlice = append(attachSlice, decoded...)
-		}
-		if !boolBreakRowLoop {
-			boolDecompressed := true
-			//Attachment byte slice in to a reader
-			attachReader := bytes.NewReader(attachSlice)
-			//Attachment Reader in to a gzip reader
-			gzipReader, err := gzip.NewReader(attachReader)
-			if err != nil {
-				logger(4, " Error creating gzip reader: "+err.Error(), false)
-				boolDecompressed = false
-			}
-			//Read gzip Reader (uncompressed data) in to byte slice using io.ReadAll
-			unComSlice, readererr := ioutil.ReadAll(gzipReader)
-			if readererr != nil {
-				logger(4, " Error creating gzip reader: "+readererr.Error(), false)
-				boolDecompressed = false
-			}
-			if boolDecompressed {
-				dataEncoded := base64.StdEncoding.EncodeToString(unComSlice)
-				gzipReader.Close()
-				requestAttachment.FileDataB64 = dataEncoded
-				if !addFileAttachmentToRequest(requestAttachment) {
-					//File attachment not added!
-					logger(4, " Error attaching file", false)
-				}
-			}
+		defer attachmentExport.abort()
+		fileContent = io.TeeReader(fileStream, attachmentExport)
+	}
+	serverFileName := ""
+	if strSink != "disk" {
+		uploadID := getAttachmentUploadID(requestAttachment)
+		defer deleteAttachmentUpload(uploadID)
+		serverFileName, err = uploadAttachmentStream(uploadID, getAttachmentFileName(requestAttachment.FileName), fileContent)
+	} else {
+		_, err = io.Copy(ioutil.Discard, fileContent)
+	}
+	if fileStream.err != nil {
+		return getAttachmentReadOutcome(fileStream.err)
+	}
+	if attachmentExport != nil && attachmentExport.err != nil {
+		return attachmentFailed, "unable to write export file: " + attachmentExport.err.Error()
+	}
+	if err != nil {
+		logger(4, "Unable to upload attachment ["+requestAttachment.FileName+"] for ["+requestAttachment.SMCallRef+"]: "+err.Error(), false)
+		return attachmentFailed, "unable to upload file: " + err.Error()
+	}
+	if snImportConf.Attachments.VerifySize && float64(fileStream.size) != requestAttachment.SizeU {
+		return attachmentCorrupt, fmt.Sprintf("content length %d bytes does not match size_bytes %.0f", fileStream.size, requestAttachment.SizeU)
+	}
+	strDetail := fmt.Sprintf("%d bytes", fileStream.size)
+	if attachmentExport != nil {
+		err = attachmentExport.commit(snCallRef, requestAttachment, fileStream.size)
+		if err != nil {
+			return attachmentFailed, "unable to write export file: " + err.Error()
+		}
+		strDetail += ", exported to " + attachmentExport.filePath
+		if strSink == "disk" {
+			return attachmentExported, strDetail
+		}
+	}
+	requestAttachment.ServerFileName = serverFileName
+	if !addFileAttachmentToRequest(requestAttachment) {
+		strDetail = "unable to attach file to request, see the log for details"
+		if attachmentExport != nil {
+			strDetail += ", exported to " + attachmentExport.filePath
 		}
+		return attachmentFailed, strDetail
 	}
+	return attachmentAttached, strDetail
 }
 
 //addFileAttachmentToRequest - takes the fileRecord data, attach this to request and update content location
 func addFileAttachmentToRequest(fileRecord fileAssocStruct) bool {
 	attPriKey := fileRecord.SMCallRef
-	useFileName := fileRecord.FileName
-	filenameReplacer := strings.NewReplacer("<", "_", ">", "_", "|", "_", "\\", "_", "/", "_", ":", "_", "*", "_", "?", "_", "\"", "_")
-	useFileName = filenameReplacer.Replace(useFileName)
+	useFileName := getAttachmentFileName(fileRecord.FileName)
 	espXmlmc, sessErr2 := NewEspXmlmcSession()
 	if sessErr2 != nil {
 		logger(4, "Unable to attach to XMLMC session to add file record.", true)
@@ -692,10 +782,7 @@ func addFileAttachmentToRequest(fileRecord fileAssocStruct) bool {
 	espXmlmc.SetParam("entity", "Requests")
 	espXmlmc.SetParam("keyValue", attPriKey)
 	espXmlmc.SetParam("folder", "/")
-	espXmlmc.OpenElement("localFile")
-	espXmlmc.SetParam("fileName", useFileName)
-	espXmlmc.SetParam("fileData", fileRecord.FileDataB64)
-	espXmlmc.CloseElement("localFile")
+	espXmlmc.SetParam("serverFileName", fileRecord.ServerFileName)
 	espXmlmc.SetParam("overwrite", "true")
 	var XMLSTRINGDATA = espXmlmc.GetParam()
 	XMLAttach, xmlmcErr := espXmlmc.Invoke("data", "entityAttachFile")
@@ -710,10 +797,12 @@ func addFileAttachmentToRequest(fileRecord fileAssocStruct) bool {
 	if err != nil {
 		logger(4, "Could not add Attachment File Data for ["+useFileName+"] ["+attPriKey+"]: "+err.Error(), false)
 		logger(1, "File Data Record XML "+XMLSTRINGDATA, false)
+		return false
 	} else {
 		if xmlRespon.MethodResult != "ok" {
 			logger(4, "Could not add Attachment File Data for ["+useFileName+"] ["+attPriKey+"]: "+xmlRespon.State.ErrorRet, false)
 			logger(1, "File Data Record XML "+XMLSTRINGDATA, false)
+			return false
 		} else {
 			//-- If we've got a Content Location back from the API, update the file record with this
 			//			if xmlRespon.ContentLocation != "" {
@@ -767,60 +856,78 @@ func addFileAttachmentToRequest(fileRecord fileAssocStruct) bool {
 }
 
 //processActivities - take records to insert as activities against Service Manager requests
-func processActivities() {
+func processActivities(activityConf snActivityConfStruct) {
 	time.Sleep(100 * time.Millisecond)
-	logger(1, "Processing Activities, please wait...", true)
-	if queryDBCallDetails("Activity", connStrAppDB) {
+	activityName := getActivityDefinitionName(activityConf)
+	logger(1, "Processing Activities ["+activityName+"], please wait...", true)
+	arrActivityDetailsMaps, boolQueryOk := queryDBActivityDetails(activityConf, connStrAppDB)
+	if boolQueryOk {
+		var wgActivity sync.WaitGroup
 		bar := pb.StartNew(len(arrActivityDetailsMaps))
 		//We have Call Details - insert them in to
 		maxGoroutinesGuard := make(chan struct{}, maxGoroutines)
-		for _, callRecord := range arrActivityDetailsMaps {
-			maxGoroutinesGuard <- struct{}{}
-			wgRequest.Add(1)
-			callRecordArr := callRecord
-			strParentRefMapping := mapActivityConf.ParentRef
-			parentRef := getFieldValue(strParentRefMapping, callRecordArr)
-
-			go func() {
-				defer wgRequest.Done()
-				time.Sleep(1 * time.Millisecond)
-				mutexBar.Lock()
-				bar.Increment()
-				mutexBar.Unlock()
-				smImported, impOk := arrCallsLogged[parentRef]
-				smCallRef := smImported.SMCallRef
-				if impOk && smCallRef != "" && smCallRef != "<nil>" {
-					boolActivity := addActivity(callRecordArr, smCallRef)
-					if boolActivity {
-						logger(3, "[ACTIVITY] Activity raised against Service Manager request ["+smCallRef+"]", false)
-					} else {
-						logger(4, "Failed Raising Activity for SM Request ["+smCallRef+"]", false)
-					}
-				}
-				<-maxGoroutinesGuard
-			}()
-		}
-		wgRequest.Wait()
+		addActivities(arrActivityDetailsMaps, activityConf, bar, maxGoroutinesGuard, &wgActivity)
+		wgActivity.Wait()
 
-		bar.FinishPrint("Request Activity Import Complete")
+		bar.FinishPrint("Request Activity Import Complete [" + activityName + "]")
 	} else {
-		logger(4, "Request Search Failed for Request Activities.", true)
+		logger(4, "Request Search Failed for Request Activities ["+activityName+"].", true)
+	}
+}
+
+//addActivities - raises an activity against the imported parent request of each activity record, using the given progress bar and
+//goroutine guard, so activity definitions imported concurrently share a single bar and a single limit on concurrent API calls
+func addActivities(arrActivityDetailsMaps []map[string]interface{}, activityConf snActivityConfStruct, bar *pb.ProgressBar, maxGoroutinesGuard chan struct{}, wgActivity *sync.WaitGroup) {
+	for _, callRecord := range arrActivityDetailsMaps {
+		maxGoroutinesGuard <- struct{}{}
+		wgActivity.Add(1)
+		callRecordArr := callRecord
+		strParentRefMapping := activityConf.ParentRef
+		parentRef := getFieldValue(strParentRefMapping, callRecordArr)
+
+		go func() {
+			defer wgActivity.Done()
+			time.Sleep(1 * time.Millisecond)
+			mutexBar.Lock()
+			bar.Increment()
+			mutexBar.Unlock()
+			mutexArrCallsLogged.Lock()
+			smImported, impOk := arrCallsLogged[parentRef]
+			mutexArrCallsLogged.Unlock()
+			smCallRef := smImported.SMCallRef
+			if impOk && smCallRef != "" && smCallRef != "<nil>" {
+				boolActivity := addActivity(callRecordArr, smCallRef, activityConf)
+				if boolActivity {
+					logger(3, "[ACTIVITY] Activity raised against Service Manager request ["+smCallRef+"]", false)
+				} else {
+					logger(4, "Failed Raising Activity for SM Request ["+smCallRef+"]", false)
+				}
+			}
+			<-maxGoroutinesGuard
+		}()
 	}
 }
 
 //addActivity - Adds an Activity against an imported Request
-func addActivity(callMap map[string]interface{}, smCallRef string) bool {
-
-	strTitle := getFieldValue(mapActivityConf.Title, callMap)
-	strDescription := getFieldValue(mapActivityConf.Description, callMap)
-	strCategory := getFieldValue(mapActivityConf.Category, callMap)
-	strStartDate := getFieldValue(mapActivityConf.StartDate, callMap)
-	strDueDate := getFieldValue(mapActivityConf.DueDate, callMap)
-	strAssignTo := getFieldValue(mapActivityConf.AssignTo, callMap)
+func addActivity(callMap map[string]interface{}, smCallRef string, activityConf snActivityConfStruct) bool {
+
+	strTitle := getFieldValue(activityConf.Title, callMap)
+	strDescription := getFieldValue(activityConf.Description, callMap)
+	strCategory := getFieldValue(activityConf.Category, callMap)
+	strStartDate := getFieldValue(activityConf.StartDate, callMap)
+	strDueDate := getFieldValue(activityConf.DueDate, callMap)
+	strAssignTo := getFieldValue(activityConf.AssignTo, callMap)
+	strAssignToTeam := getFieldValue(activityConf.AssignToTeam, callMap)
+	if activityConf.AppendJournal {
+		strDescription += getActivityJournal(fmt.Sprintf("%s", callMap["task_guid"]))
+	}
 	//Is strStatus = closed, close the activity once it's been raised
-	strStatus := getFieldValue(mapActivityConf.Status, callMap)
-	strDecision := getFieldValue(mapActivityConf.Decision, callMap)
-	strReason := getFieldValue(mapActivityConf.Reason, callMap)
+	strStatus := getFieldValue(activityConf.Status, callMap)
+	strDecision := getFieldValue(activityConf.Decision, callMap)
+	strReason := getFieldValue(activityConf.Reason, callMap)
+	strCreatedDate := getFieldValue(activityConf.CreatedDate, callMap)
+	strCompletedDate := getFieldValue(activityConf.CompletedDate, callMap)
+	strCompletedBy := getFieldValue(activityConf.CompletedBy, callMap)
 
 	espXmlmc, err := NewEspXmlmcSession()
 	if err != nil {
@@ -839,42 +946,36 @@ func addActivity(callMap map[string]interface{}, smCallRef string) bool {
 	if strDueDate != "" {
 		espXmlmc.SetParam("dueDate", strDueDate)
 	}
+	boolAssigned := false
 	if strAssignTo != "" {
 		boolUserExists, _, strAssignToID := recordInCache(strAssignTo, "Analyst")
 		if boolUserExists {
 			espXmlmc.SetParam("assignTo", "urn:sys:user:"+strAssignToID)
+			boolAssigned = true
 		} else {
 			boolUserExists = doesCustomerExist(strAssignTo)
 			if boolUserExists {
 				espXmlmc.SetParam("assignTo", "urn:sys:user:"+strAssignTo)
+				boolAssigned = true
 			}
 		}
 	}
-	if strCategory == "BPM Authorisation" {
-		espXmlmc.OpenElement("outcome")
-		espXmlmc.SetParam("outcome", "accept")
-		espXmlmc.OpenElement("displayName")
-		espXmlmc.SetParam("text", "Authorise")
-		espXmlmc.CloseElement("displayName")
-		espXmlmc.SetParam("buttonColor", "default")
-		espXmlmc.SetParam("requiresReason", "false")
-		espXmlmc.CloseElement("outcome")
-		espXmlmc.OpenElement("outcome")
-		espXmlmc.SetParam("outcome", "refuse")
-		espXmlmc.OpenElement("displayName")
-		espXmlmc.SetParam("text", "Rejected")
-		espXmlmc.CloseElement("displayName")
-		espXmlmc.SetParam("buttonColor", "default")
-		espXmlmc.SetParam("requiresReason", "true")
-		espXmlmc.CloseElement("outcome")
-	} else {
+	//Assign to the team where there is no user to assign to
+	if !boolAssigned && strAssignToTeam != "" {
+		strTeamID, _ := getCallTeamID(strAssignToTeam)
+		if strTeamID != "" {
+			espXmlmc.SetParam("assignTo", "urn:sys:group:"+strTeamID)
+		}
+	}
+	activityOutcomes := getActivityOutcomes(strCategory, activityConf)
+	for _, activityOutcome := range activityOutcomes {
 		espXmlmc.OpenElement("outcome")
-		espXmlmc.SetParam("outcome", "done")
+		espXmlmc.SetParam("outcome", activityOutcome)
 		espXmlmc.OpenElement("displayName")
-		espXmlmc.SetParam("text", "Done")
+		espXmlmc.SetParam("text", getOutcomeDisplayName(activityOutcome))
 		espXmlmc.CloseElement("displayName")
 		espXmlmc.SetParam("buttonColor", "default")
-		espXmlmc.SetParam("requiresReason", "false")
+		espXmlmc.SetParam("requiresReason", strconv.FormatBool(activityOutcome == "refuse"))
 		espXmlmc.CloseElement("outcome")
 	}
 	espXmlmc.SetParam("objectRefUrn", "urn:sys:entity:com.hornbill.servicemanager:Requests:"+smCallRef)
@@ -905,32 +1006,38 @@ func addActivity(callMap map[string]interface{}, smCallRef string) bool {
 		logger(4, "Unable to log request: "+xmlRespon.State.ErrorRet, false)
 		return false
 	}
-	if xmlRespon.TaskID != "" && xmlRespon.TaskID != "<nil>" && (strStatus == "Closed Complete" || strStatus == "Closed Incomplete") {
-		//Mark the task as COMPLETE
-		espXmlmc, err := NewEspXmlmcSession()
-		if err != nil {
-			return false
+	if xmlRespon.TaskID == "" || xmlRespon.TaskID == "<nil>" {
+		return true
+	}
+	//Task API sets the created and completed details to now and the API user, so set the originals afterwards
+	taskColumns := make(map[string]string)
+	if strCreatedDate != "" {
+		taskColumns["h_created_on"] = strCreatedDate
+	}
+	switch getActivityAction(strStatus, activityConf) {
+	case "complete":
+		strOutcome := getActivityOutcome(strDecision, strCategory, activityOutcomes, activityConf)
+		if strOutcome == "" {
+			logger(5, "Activity ["+xmlRespon.TaskID+"] against ["+smCallRef+"] left open, as decision ["+strDecision+"] is not in the OutcomeMapping", false)
+			break
 		}
-		espXmlmc.SetParam("taskId", xmlRespon.TaskID)
-		espXmlmc.SetParam("outcome", strDecision+"\n"+strReason)
-		XMLCreate, xmlmcErr := espXmlmc.Invoke("task", "taskComplete")
-
-		if xmlmcErr != nil {
-			logger(4, "Unable to complete activity on Hornbill instance: "+xmlmcErr.Error(), false)
+		if !completeActivity(xmlRespon.TaskID, strOutcome, strReason) {
 			return false
 		}
-		var xmlTaskRespon xmlmcResponse
-
-		err = xml.Unmarshal([]byte(XMLCreate), &xmlTaskRespon)
-		if err != nil {
-			logger(4, "Unable to read complete activity response on Hornbill instance:"+err.Error(), false)
-			return false
+		if strCompletedDate != "" {
+			taskColumns["h_completed_on"] = strCompletedDate
+		}
+		if strCompletedByID := getActivityUserID(strCompletedBy); strCompletedByID != "" {
+			taskColumns["h_completed_by"] = "urn:sys:user:" + strCompletedByID
 		}
-		if xmlTaskRespon.MethodResult != "ok" {
-			logger(4, "Unable to complete activity: "+xmlTaskRespon.State.ErrorRet, false)
+	case "cancel":
+		if !cancelActivity(xmlRespon.TaskID, strReason) {
 			return false
 		}
 	}
+	if len(taskColumns) > 0 {
+		updateActivityRecord(xmlRespon.TaskID, taskColumns)
+	}
 	return true
 }
 
@@ -956,7 +1063,7 @@ func processCallAssociations() {
 			time.Sleep(1 * time.Millisecond)
 			if smMasterRef != "" && smMasterRef != "<nil>" && smCallRef != "" {
 				//We have Master and Slave calls matched in the SM database
-				addAssocRecord(smMasterRef, smCallRef)
+				addAssocRecord(smMasterRef, smCallRef, "")
 			}
 			mutexBar.Lock()
 			bar.Increment()
@@ -970,7 +1077,8 @@ func processCallAssociations() {
 }
 
 //addAssocRecord - given a Master Reference and a Slave Refernce, adds a call association record to Service Manager
-func addAssocRecord(masterRef, slaveRef string) {
+//The ServiceNow relationship name is kept in the Relationships NameColumn, when one is configured
+func addAssocRecord(masterRef, slaveRef, relationshipName string) {
 	espXmlmc, err := NewEspXmlmcSession()
 	if err != nil {
 		return
@@ -981,6 +1089,9 @@ func addAssocRecord(masterRef, slaveRef string) {
 	espXmlmc.OpenElement("record")
 	espXmlmc.SetParam("h_fk_parentrequestid", masterRef)
 	espXmlmc.SetParam("h_fk_childrequestid", slaveRef)
+	if relationshipName != "" && snImportConf.Relationships.NameColumn != "" {
+		espXmlmc.SetParam(snImportConf.Relationships.NameColumn, relationshipName)
+	}
 	espXmlmc.CloseElement("record")
 	espXmlmc.CloseElement("primaryEntityData")
 	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
@@ -1000,7 +1111,7 @@ func addAssocRecord(masterRef, slaveRef string) {
 		return
 	}
 	if configDebug {
-		logger(1, "Request Association Success between ["+masterRef+"] and ["+slaveRef+"]", false)
+		logger(1, "Request Association Success between ["+masterRef+"] and ["+slaveRef+"] "+relationshipName, false)
 	}
 }
 
@@ -1018,6 +1129,7 @@ func processCallData() {
 			wgRequest.Add(1)
 			callRecordArr := callRecord
 			callRecordCallref := fmt.Sprintf("%s", callRecord["callref"])
+			callRecordKey := getCallsLoggedKey(callRecordCallref)
 
 			go func() {
 				defer wgRequest.Done()
@@ -1025,7 +1137,7 @@ func processCallData() {
 				mutexBar.Lock()
 				bar.Increment()
 				mutexBar.Unlock()
-				boolCallLogged, hbCallRef := logNewCall(mapGenericConf.CallClass, callRecordArr, callRecordCallref)
+				boolCallLogged, hbCallRef := logNewCall(mapGenericConf.CallClass, callRecordArr, callRecordKey)
 				if boolCallLogged {
 					logger(3, "[REQUEST] Request "+hbCallRef+" raised from Task "+callRecordCallref, false)
 				} else {
@@ -1070,16 +1182,9 @@ func queryDBCallDetails(callClass, connString string) bool {
 
 	strSQLQuery := ""
 	//build query
-	if callClass == "Activity" {
-		arrQueryLen := len(mapActivityConf.SQLStatement)
-		for i := 0; i < arrQueryLen; i++ {
-			strSQLQuery += " " + fmt.Sprintf("%s", mapActivityConf.SQLStatement[strconv.Itoa(i)])
-		}
-	} else {
-		arrQueryLen := len(mapGenericConf.SQLStatement)
-		for i := 0; i < arrQueryLen; i++ {
-			strSQLQuery += " " + fmt.Sprintf("%s", mapGenericConf.SQLStatement[strconv.Itoa(i)])
-		}
+	arrQueryLen := len(mapGenericConf.SQLStatement)
+	for i := 0; i < arrQueryLen; i++ {
+		strSQLQuery += " " + fmt.Sprintf("%s", mapGenericConf.SQLStatement[strconv.Itoa(i)])
 	}
 	if configDebug {
 		logger(1, "[DATABASE] Query to retrieve "+callClass+" tasks from ServiceNow data: "+strSQLQuery, false)
@@ -1091,27 +1196,14 @@ func queryDBCallDetails(callClass, connString string) bool {
 		logger(4, " Database Query Error: "+err.Error(), true)
 		return false
 	}
-	if callClass == "Activity" {
-		//Clear down existing Call Details map
-		arrActivityDetailsMaps = nil
-		//Build map full of calls to import
-		for rows.Next() {
-			results := make(map[string]interface{})
-			_ = rows.MapScan(results)
-			//Stick marshalled data map in to parent slice
-			arrActivityDetailsMaps = append(arrActivityDetailsMaps, results)
-		}
-
-	} else {
-		//Clear down existing Call Details map
-		arrCallDetailsMaps = nil
-		//Build map full of calls to import
-		for rows.Next() {
-			results := make(map[string]interface{})
-			_ = rows.MapScan(results)
-			//Stick marshalled data map in to parent slice
-			arrCallDetailsMaps = append(arrCallDetailsMaps, results)
-		}
+	//Clear down existing Call Details map
+	arrCallDetailsMaps = nil
+	//Build map full of calls to import
+	for rows.Next() {
+		results := make(map[string]interface{})
+		_ = rows.MapScan(results)
+		//Stick marshalled data map in to parent slice
+		arrCallDetailsMaps = append(arrCallDetailsMaps, results)
 	}
 	defer rows.Close()
 	return true
@@ -1156,6 +1248,7 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 	strLoggedDate := ""
 	strCreatedBy := ""
 	strClosedDate := ""
+	strCustomerID := ""
 	analystIDFields := make(map[string]string)
 	analystIDFields["h_ownerid"] = "h_ownername"
 	analystIDFields["h_createdby"] = ""
@@ -1181,12 +1274,20 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 			strAnalystID := getFieldValue(strMapping, callMap)
 			if strAnalystID != "" {
 				analystIsInCache, strOwnerName, strAnalystID := recordInCache(strAnalystID, "Analyst")
+				if !analystIsInCache || strOwnerName == "" {
+					counters.Lock()
+					counters.analystsUnresolved++
+					counters.Unlock()
+					analystIsInCache, strOwnerName, strAnalystID = getAnalystFallback(strAttribute, nameField, getFieldValue(strMapping, callMap), callMap)
+				}
 				if analystIsInCache && strOwnerName != "" {
 					if strAttribute == "h_createdby" {
 						strCreatedBy = strAnalystID
 						boolUpdateCreatedBy = true
 					} else {
-						espXmlmc.SetParam(strAttribute, strAnalystID)
+						if strAnalystID != "" {
+							espXmlmc.SetParam(strAttribute, strAnalystID)
+						}
 						if nameField != "" {
 							espXmlmc.SetParam(nameField, strOwnerName)
 						}
@@ -1207,12 +1308,18 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 					if customerIsInCache && strCustName != "" {
 						espXmlmc.SetParam(strAttribute, strID)
 						espXmlmc.SetParam("h_fk_user_name", strCustName)
+						strCustomerID = strCustID
 					}
 				}
 			}
 			boolAutoProcess = false
 		}
 
+		//Organisation ID & Name - set once all fields are processed, as they can fall back to the customer organisation
+		if mapGenericConf.Organisation.Lookup && (strAttribute == "h_company_id" || strAttribute == "h_company_name") {
+			boolAutoProcess = false
+		}
+
 		//Priority ID & Name
 		//-- Get Priority ID
 		if strAttribute == "h_fk_priorityid" {
@@ -1377,6 +1484,17 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 
 	}
 
+	//Organisation ID & Name
+	if mapGenericConf.Organisation.Lookup {
+		strOrganisationID, strOrganisationName := getOrganisation(callMap, strCustomerID)
+		if strOrganisationID != "" {
+			espXmlmc.SetParam("h_company_id", strOrganisationID)
+		}
+		if strOrganisationName != "" {
+			espXmlmc.SetParam("h_company_name", strOrganisationName)
+		}
+	}
+
 	//Add request class & prefix
 	espXmlmc.SetParam("h_requesttype", callClass)
 	espXmlmc.SetParam("h_request_prefix", reqPrefix)
@@ -1389,15 +1507,9 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 	espXmlmc.SetParam("relationshipName", "Call Type")
 	espXmlmc.SetParam("entityAction", "insert")
 	espXmlmc.OpenElement("record")
-	strAttribute = ""
-	strMapping = ""
-	//Loop through AdditionalFieldMapping fields from config, add to XMLMC Params if not empty
-	for k, v := range mapGenericConf.AdditionalFieldMapping {
-		strAttribute = fmt.Sprintf("%v", k)
-		strMapping = fmt.Sprintf("%v", v)
-		if strMapping != "" && getFieldValue(strMapping, callMap) != "" {
-			espXmlmc.SetParam(strAttribute, getFieldValue(strMapping, callMap))
-		}
+	//Add AdditionalFieldMapping and ChangeFields columns from config
+	for k, v := range getCallTypeFields(callMap) {
+		espXmlmc.SetParam(k, v)
 	}
 
 	espXmlmc.CloseElement("record")
@@ -1517,7 +1629,11 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 				}
 			}
 			//Now add status history
-			addStatusHistory(strNewCallRef, strStatus, strLoggedDate, espXmlmc)
+			if mapGenericConf.StatusHistory.Import {
+				addFullStatusHistory(strNewCallRef, strStatus, strLoggedDate, fmt.Sprintf("%s", callMap["request_guid"]), espXmlmc)
+			} else {
+				addStatusHistory(strNewCallRef, strStatus, strLoggedDate, espXmlmc)
+			}
 
 			//Now update CreatedBy
 			if boolUpdateCreatedBy {
@@ -1641,14 +1757,90 @@ func logNewCall(callClass string, callMap map[string]interface{}, snCallID strin
 	}
 
 	//-- If request logged successfully :
+	//Get the catalog variables of the request item, and add them as request questions
+	if boolCallLoggedOK && strNewCallRef != "" && mapGenericConf.CatalogVariables.Import {
+		strDescription := ""
+		if descMapping, ok := mapGenericConf.CoreFieldMapping["h_description"]; ok {
+			strDescription = getFieldValue(fmt.Sprintf("%v", descMapping), callMap)
+		}
+		processCatalogVariables(strNewCallRef, fmt.Sprintf("%s", callMap["request_guid"]), strDescription)
+	}
+	//Add the change plans as historic updates
+	if boolCallLoggedOK && strNewCallRef != "" && len(mapGenericConf.ChangeFields.PlanUpdates) > 0 {
+		addChangePlanUpdates(strNewCallRef, strLoggedDate, callMap)
+	}
+	//Link known errors to their problem and its incidents
+	if boolCallLoggedOK && strNewCallRef != "" && (mapGenericConf.KnownErrorLinks.LinkProblem || mapGenericConf.KnownErrorLinks.LinkIncidents) {
+		linkKnownError(strNewCallRef, fmt.Sprintf("%s", callMap["callref"]), fmt.Sprintf("%s", callMap["request_guid"]))
+	}
+	//Link the affected CIs of the task to the request as assets
+	if boolCallLoggedOK && strNewCallRef != "" && mapGenericConf.AssetLinks.Import {
+		processTaskCIs(strNewCallRef, fmt.Sprintf("%s", callMap["callref"]), fmt.Sprintf("%s", callMap["request_guid"]))
+	}
+	//Add the watch lists of the task as request connections
+	if boolCallLoggedOK && strNewCallRef != "" && mapGenericConf.WatchList.Import {
+		processWatchLists(strNewCallRef, fmt.Sprintf("%s", callMap["callref"]), fmt.Sprintf("%s", callMap["request_guid"]))
+	}
+	//Add the time worked on the task as time entries against the request
+	if boolCallLoggedOK && strNewCallRef != "" && mapGenericConf.TimeWorked.Import {
+		processTimeWorked(strNewCallRef, fmt.Sprintf("%s", callMap["callref"]), fmt.Sprintf("%s", callMap["request_guid"]))
+	}
+	//Get the SLA history of the task, and apply it to the request
+	if boolCallLoggedOK && strNewCallRef != "" && mapGenericConf.SLA.Import {
+		processTaskSLAs(strNewCallRef, fmt.Sprintf("%s", callMap["request_guid"]))
+	}
 	//Get the Call Diary Updates from ServiceNow and build the Historical Updates against the SM request
 	if boolCallLoggedOK && strNewCallRef != "" {
-		applyHistoricalUpdates(strNewCallRef, snCallID, fmt.Sprintf("%s", callMap["request_guid"]))
+		snTeam := ""
+		if teamMapping, ok := mapGenericConf.CoreFieldMapping["h_fk_team_id"]; ok {
+			snTeam = getFieldValue(fmt.Sprintf("%v", teamMapping), callMap)
+		}
+		applyHistoricalUpdates(strNewCallRef, snCallID, fmt.Sprintf("%s", callMap["request_guid"]), snTeam)
+	}
+	//Get the emails sent and received against the task, and add them to the request
+	if boolCallLoggedOK && strNewCallRef != "" && mapGenericConf.Emails.Import {
+		processTaskEmails(strNewCallRef, fmt.Sprintf("%s", callMap["callref"]), fmt.Sprintf("%s", callMap["request_guid"]))
 	}
 
 	return boolCallLoggedOK, strNewCallRef
 }
 
+//getAnalystFallback - applies the configured fallback for an analyst field whose ServiceNow analyst could not be resolved.
+//Returns the same values as recordInCache, with an empty ID when only the source name text is being kept
+func getAnalystFallback(strAttribute, nameField, strSourceID string, callMap map[string]interface{}) (bool, string, string) {
+	fallback, ok := mapGenericConf.AnalystFallback[strAttribute]
+	if !ok {
+		logger(5, "Analyst ["+strSourceID+"] for field ["+strAttribute+"] could not be resolved, field will not be populated", false)
+		return false, "", ""
+	}
+	switch fallback.Method {
+	case "default":
+		analystIsInCache, strName, strID := recordInCache(fallback.DefaultAnalyst, "Analyst")
+		if !analystIsInCache {
+			logger(4, "Default Analyst ["+fallback.DefaultAnalyst+"] for field ["+strAttribute+"] could not be resolved", false)
+			return false, "", ""
+		}
+		logger(5, "Analyst ["+strSourceID+"] for field ["+strAttribute+"] could not be resolved, using Default Analyst ["+strID+"]", false)
+		return true, strName, strID
+	case "name":
+		if nameField == "" {
+			logger(5, "Analyst ["+strSourceID+"] for field ["+strAttribute+"] could not be resolved, and field has no name column to hold the source name", false)
+			return false, "", ""
+		}
+		strName := ""
+		if nameMapping, ok := mapGenericConf.CoreFieldMapping[nameField]; ok {
+			strName = getFieldValue(fmt.Sprintf("%v", nameMapping), callMap)
+		}
+		if strName == "" {
+			strName = strSourceID
+		}
+		logger(5, "Analyst ["+strSourceID+"] for field ["+strAttribute+"] could not be resolved, keeping source name ["+strName+"] in ["+nameField+"]", false)
+		return true, strName, ""
+	}
+	logger(4, "Unknown AnalystFallback Method ["+fallback.Method+"] for field ["+strAttribute+"]", false)
+	return false, "", ""
+}
+
 func addStatusHistory(requestRef, requestStatus, dateLogged string, espXmlmc *apiLib.XmlmcInstStruct) {
 	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
 	espXmlmc.SetParam("entity", "RequestStatusHistory")
@@ -1694,7 +1886,7 @@ func convExtendedColName(oldColName string) string {
 }
 
 //applyHistoricalUpdates - takes call diary records from ServiceNow, imports to Hornbill as Historical Updates
-func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
+func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID, snTeam string) bool {
 	espXmlmc, err := NewEspXmlmcSession()
 	if err != nil {
 		return false
@@ -1716,7 +1908,9 @@ func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
 	//mutex.Lock()
 	//build query
 	sqlDiaryQuery := "SELECT element, value, sys_created_by, sys_created_on "
-	sqlDiaryQuery = sqlDiaryQuery + " FROM sys_journal_field WHERE element_id = '" + snTaskSysID + "' ORDER BY sys_created_on ASC"
+	sqlDiaryQuery = sqlDiaryQuery + " FROM sys_journal_field WHERE element_id = '" + snTaskSysID + "'"
+	sqlDiaryQuery = sqlDiaryQuery + getJournalElementFilter()
+	sqlDiaryQuery = sqlDiaryQuery + " ORDER BY sys_created_on ASC"
 	if configDebug {
 		logger(1, "[DATABASE] Running query for Historical Updates of call "+snCallRef+". Please wait...", false)
 		logger(1, "[DATABASE] Diary Query: "+sqlDiaryQuery, false)
@@ -1728,7 +1922,10 @@ func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
 		logger(4, " Database Query Error: "+err.Error(), false)
 		return false
 	}
-	rowCounter := 0
+	var groupChanges []assignmentGroupChangeStruct
+	if snImportConf.HistoricUpdates.TeamFromAssignmentGroup {
+		groupChanges = getAssignmentGroupChanges(db, snTaskSysID)
+	}
 	//Process each call diary entry, insert in to Hornbill
 	for rows.Next() {
 		diaryEntry := make(map[string]interface{})
@@ -1736,7 +1933,6 @@ func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
 		if err != nil {
 			logger(4, "Unable to retrieve data from SQL query: "+err.Error(), false)
 		} else {
-			rowCounter++
 			//Update Time
 			diaryTime := ""
 			if diaryEntry["sys_created_on"] != nil {
@@ -1745,17 +1941,40 @@ func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
 
 			//Check for source/code/text having nil value
 			diarySource := ""
+			diaryElement := journalElementStruct{}
 			if diaryEntry["element"] != nil {
-				diarySource = fmt.Sprintf("%+s", diaryEntry["element"]) + " (" + fmt.Sprintf("%+s", diaryEntry["sys_created_by"]) + ")"
+				diaryElement = getJournalElement(fmt.Sprintf("%+s", diaryEntry["element"]))
+				diarySource = diaryElement.Label
+				if diaryElement.Visibility != "" {
+					diarySource += " [" + getVisibilityLabel(diaryElement.Visibility) + "]"
+				}
+				diarySource += " (" + fmt.Sprintf("%+s", diaryEntry["sys_created_by"]) + ")"
 			}
 
 			diaryText := ""
 			if diaryEntry["value"] != nil {
 				diaryText = fmt.Sprintf("%+s", diaryEntry["value"])
-				diaryText = html.EscapeString(diaryText)
 			}
 
-			diaryIndex := strconv.Itoa(rowCounter)
+			updateByID, updateByName, updateByType := getHistoricUpdateAuthor(fmt.Sprintf("%+s", diaryEntry["sys_created_by"]))
+
+			//Replay element to the activity stream, in addition to or instead of the Historic Updates
+			if strings.EqualFold(diaryElement.Target, "timeline") || strings.EqualFold(diaryElement.Target, "both") {
+				if !configDryRun {
+					strHeader := getTimelineHeader(diaryElement.Label, updateByName, diaryTime)
+					postTimelineEntry(newCallRef, strHeader+"\n\n"+diaryText, getTimelineVisibility(diaryElement.Visibility))
+				}
+				if !strings.EqualFold(diaryElement.Target, "both") {
+					continue
+				}
+			}
+
+			diaryIndex := getHistoricUpdateIndex(newCallRef)
+			diaryText = html.EscapeString(diaryText)
+			updateByGroup := ""
+			if snImportConf.HistoricUpdates.TeamFromAssignmentGroup {
+				updateByGroup, _ = getCallTeamID(getAssignmentGroupAt(groupChanges, diaryTime, snTeam))
+			}
 
 			espXmlmc.SetParam("application", appServiceManager)
 			espXmlmc.SetParam("entity", "RequestHistoricUpdates")
@@ -1763,11 +1982,13 @@ func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
 			espXmlmc.OpenElement("record")
 			espXmlmc.SetParam("h_fk_reference", newCallRef)
 			espXmlmc.SetParam("h_updatedate", diaryTime)
-			espXmlmc.SetParam("h_updatebytype", "1")
+			espXmlmc.SetParam("h_updatebytype", updateByType)
 			espXmlmc.SetParam("h_updateindex", diaryIndex)
-			espXmlmc.SetParam("h_updateby", fmt.Sprintf("%+s", diaryEntry["sys_created_by"]))
-			espXmlmc.SetParam("h_updatebyname", fmt.Sprintf("%+s", diaryEntry["sys_created_by"]))
-			/*espXmlmc.SetParam("h_updatebygroup", fmt.Sprintf("%+s", diaryEntry["groupid"]))*/
+			espXmlmc.SetParam("h_updateby", updateByID)
+			espXmlmc.SetParam("h_updatebyname", updateByName)
+			if updateByGroup != "" {
+				espXmlmc.SetParam("h_updatebygroup", updateByGroup)
+			}
 			if diarySource != "" {
 				espXmlmc.SetParam("h_actionsource", diarySource)
 			}
@@ -1810,6 +2031,238 @@ func applyHistoricalUpdates(newCallRef, snCallRef, snTaskSysID string) bool {
 	return true
 }
 
+var (
+	mutexAuthorMisses = &sync.Mutex{}
+	authorMisses      = make(map[string]bool)
+)
+
+//getHistoricUpdateAuthor - resolves the ServiceNow author of a journal entry to a Hornbill user ID, name and update type
+//Analysts return type 1, customers type 2. Unresolved authors are returned as-is, as an analyst update
+func getHistoricUpdateAuthor(snUser string) (string, string, string) {
+	if snUser == "" || snUser == "<nil>" || !snImportConf.HistoricUpdates.ResolveAuthors {
+		return snUser, snUser, "1"
+	}
+	analystIsInCache, strAnalystName, strAnalystID := recordInCache(snUser, "Analyst")
+	if analystIsInCache && strAnalystName != "" {
+		return strAnalystID, strAnalystName, "1"
+	}
+	if doesAuthorCustomerExist(snUser) {
+		customerIsInCache, strCustName, strCustID := recordInCache(snUser, "Customer")
+		if customerIsInCache && strCustName != "" {
+			return strCustID, strCustName, "2"
+		}
+	}
+	if configDebug {
+		logger(1, "Historic Update author ["+snUser+"] could not be resolved to an Analyst or Customer", false)
+	}
+	return snUser, snUser, "1"
+}
+
+//doesAuthorCustomerExist - returns whether a ServiceNow user who authored an update or activity is a Hornbill customer. Users that are not,
+//such as system or deleted users, are remembered, so each one is only searched for once rather than once per journal entry or activity
+func doesAuthorCustomerExist(snUser string) bool {
+	mutexAuthorMisses.Lock()
+	boolMissed := authorMisses[snUser]
+	mutexAuthorMisses.Unlock()
+	if boolMissed {
+		return false
+	}
+	if doesCustomerExist(snUser) {
+		return true
+	}
+	mutexAuthorMisses.Lock()
+	authorMisses[snUser] = true
+	mutexAuthorMisses.Unlock()
+	return false
+}
+
+//getAssignmentGroupChanges - returns the assignment group changes audited against a ServiceNow task, oldest first
+func getAssignmentGroupChanges(db *sqlx.DB, snTaskSysID string) []assignmentGroupChangeStruct {
+	var groupChanges []assignmentGroupChangeStruct
+	sqlAuditQuery := "SELECT sys_audit.sys_created_on, COALESCE(old_group.name, '') AS old_group, COALESCE(new_group.name, '') AS new_group "
+	sqlAuditQuery += " FROM sys_audit "
+	sqlAuditQuery += " LEFT JOIN sys_user_group old_group ON sys_audit.oldvalue = old_group.sys_id "
+	sqlAuditQuery += " LEFT JOIN sys_user_group new_group ON sys_audit.newvalue = new_group.sys_id "
+	sqlAuditQuery += " WHERE sys_audit.documentkey = '" + snTaskSysID + "' AND sys_audit.fieldname = 'assignment_group' "
+	sqlAuditQuery += " ORDER BY sys_audit.sys_created_on ASC"
+	if configDebug {
+		logger(1, "[DATABASE] Assignment Group Audit Query: "+sqlAuditQuery, false)
+	}
+	err := db.Select(&groupChanges, sqlAuditQuery)
+	if err != nil {
+		logger(4, " Database Query Error for Assignment Group Audit: "+err.Error(), false)
+	}
+	return groupChanges
+}
+
+//getAssignmentGroupAt - returns the ServiceNow assignment group a task was assigned to at the given time
+//If no changes were audited, the task's current group is returned
+func getAssignmentGroupAt(groupChanges []assignmentGroupChangeStruct, atTime, currentGroup string) string {
+	if len(groupChanges) == 0 {
+		return currentGroup
+	}
+	parsedAtTime, ok := parseDateTime(atTime)
+	if !ok {
+		return currentGroup
+	}
+	group := ""
+	for i, change := range groupChanges {
+		changedOn, ok := parseDateTime(change.ChangedOn)
+		if ok && changedOn.After(parsedAtTime) {
+			if i == 0 {
+				group = change.OldGroup
+			}
+			break
+		}
+		group = change.NewGroup
+	}
+	return group
+}
+
+//getJournalElement - returns the import configuration for a sys_journal_field element, defaulting the label to the element name
+func getJournalElement(elementName string) journalElementStruct {
+	journalElement := snImportConf.HistoricUpdates.Elements[elementName]
+	if journalElement.Label == "" {
+		journalElement.Label = elementName
+	}
+	return journalElement
+}
+
+//getJournalElementFilter - returns the condition restricting a sys_journal_field query to the HistoricUpdates Elements, where listed
+func getJournalElementFilter() string {
+	if len(snImportConf.HistoricUpdates.Elements) == 0 {
+		return ""
+	}
+	var elementList []string
+	for elementName := range snImportConf.HistoricUpdates.Elements {
+		elementList = append(elementList, "'"+strings.Replace(elementName, "'", "''", -1)+"'")
+	}
+	return " AND element IN (" + strings.Join(elementList, ", ") + ")"
+}
+
+//getVisibilityLabel - returns the display label for a journal element visibility, added to the action source of Historic Updates,
+//as RequestHistoricUpdates records have no visibility of their own
+func getVisibilityLabel(visibility string) string {
+	if strings.EqualFold(visibility, "customer") {
+		return "Customer"
+	}
+	if strings.EqualFold(visibility, "public") {
+		return "Public"
+	}
+	return "Internal"
+}
+
+//getTimelineVisibility - converts a journal element visibility to a Hornbill activity stream visibility. Posts are internal (colleague)
+//unless customer or public visibility is configured explicitly, so entries such as work notes are never published by default
+func getTimelineVisibility(visibility string) string {
+	switch strings.ToLower(visibility) {
+	case "customer":
+		return "trustedGuest"
+	case "public":
+		return "public"
+	}
+	return "colleague"
+}
+
+//getTimelineHeader - builds the text header of a replayed journal entry from the TimelineHeader template, which records the
+//original author and timestamp of the entry in the post content, as the post itself is made by the API key user at import time
+func getTimelineHeader(label, author, timestamp string) string {
+	strTemplate := snImportConf.HistoricUpdates.TimelineHeader
+	if strTemplate == "" {
+		strTemplate = "[label] by [author] on [timestamp]"
+	}
+	headerMap := make(map[string]interface{})
+	headerMap["label"] = label
+	headerMap["author"] = author
+	headerMap["timestamp"] = timestamp
+	return getFieldValue(strTemplate, headerMap)
+}
+
+//postTimelineEntry - posts an update to the activity stream of an imported request
+func postTimelineEntry(requestRef, content, visibility string) bool {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return false
+	}
+	espXmlmc.SetParam("socialObjectRef", "urn:sys:entity:"+appServiceManager+":Requests:"+requestRef)
+	espXmlmc.SetParam("content", content)
+	espXmlmc.SetParam("visibility", visibility)
+	espXmlmc.SetParam("type", "Update")
+	XMLPost, xmlmcErr := espXmlmc.Invoke("activity", "postMessage")
+	if xmlmcErr != nil {
+		logger(4, "Unable to post timeline update to ["+requestRef+"]: "+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLPost), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read response from Hornbill instance for timeline update to ["+requestRef+"]: "+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to post timeline update to ["+requestRef+"]: "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
+
+var (
+	mutexHistoricUpdateIndexes = &sync.Mutex{}
+	arrHistoricUpdateIndexes   = make(map[string]int)
+)
+
+//getHistoricUpdateIndex - returns the next Historic Update index of an imported request, so updates from the journal, emails
+//and change plans are indexed in the order they are added
+func getHistoricUpdateIndex(requestRef string) string {
+	mutexHistoricUpdateIndexes.Lock()
+	defer mutexHistoricUpdateIndexes.Unlock()
+	arrHistoricUpdateIndexes[requestRef]++
+	return strconv.Itoa(arrHistoricUpdateIndexes[requestRef])
+}
+
+//addHistoricUpdate - adds a single Historic Update to an imported request, for updates that do not come from sys_journal_field
+func addHistoricUpdate(requestRef, updateDate, updateIndex, updateBy, updateByName, updateByType, updateSource, updateText string) bool {
+	if configDryRun {
+		return true
+	}
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		return false
+	}
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "RequestHistoricUpdates")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_fk_reference", requestRef)
+	if updateDate != "" {
+		espXmlmc.SetParam("h_updatedate", updateDate)
+	}
+	espXmlmc.SetParam("h_updatebytype", updateByType)
+	espXmlmc.SetParam("h_updateindex", updateIndex)
+	espXmlmc.SetParam("h_updateby", updateBy)
+	espXmlmc.SetParam("h_updatebyname", updateByName)
+	espXmlmc.SetParam("h_actionsource", updateSource)
+	espXmlmc.SetParam("h_description", html.EscapeString(updateText))
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to add "+updateSource+" Historic Update to ["+requestRef+"]: "+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to add "+updateSource+" Historic Update to ["+requestRef+"]: "+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to add "+updateSource+" Historic Update to ["+requestRef+"]: "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
+
 // getFieldValue --Retrieve field value from mapping via SQL record map
 func getFieldValue(v string, u map[string]interface{}) string {
 	fieldMap := v
@@ -1827,27 +2280,19 @@ func getFieldValue(v string, u map[string]interface{}) string {
 		valFieldMap = strings.Replace(val, "[", "", 1)
 		valFieldMap = strings.Replace(valFieldMap, "]", "", 1)
 
-		if valFieldMap == "callclass" {
-			if fmt.Sprintf("%+s", u[valFieldMap]) == "sc_task" {
-				fieldMap = strings.Replace(fieldMap, val, "Child Task of Parent Request!", 1)
+		if u[valFieldMap] != nil {
+
+			if valField, ok := u[valFieldMap].(int64); ok {
+				valFieldMap = strconv.FormatInt(valField, 10)
 			} else {
-				fieldMap = strings.Replace(fieldMap, val, "", 1)
+				valFieldMap = fmt.Sprintf("%+s", u[valFieldMap])
 			}
-		} else {
-			if u[valFieldMap] != nil {
-
-				if valField, ok := u[valFieldMap].(int64); ok {
-					valFieldMap = strconv.FormatInt(valField, 10)
-				} else {
-					valFieldMap = fmt.Sprintf("%+s", u[valFieldMap])
-				}
 
-				if valFieldMap != "<nil>" {
-					fieldMap = strings.Replace(fieldMap, val, valFieldMap, 1)
-				}
-			} else {
-				fieldMap = strings.Replace(fieldMap, val, "", 1)
+			if valFieldMap != "<nil>" {
+				fieldMap = strings.Replace(fieldMap, val, valFieldMap, 1)
 			}
+		} else {
+			fieldMap = strings.Replace(fieldMap, val, "", 1)
 		}
 	}
 	return fieldMap
@@ -2551,6 +2996,14 @@ func loadConfig() (snImportConfStruct, bool) {
 	return edbConf, boolLoadConf
 }
 
+//quoteIdentifier -- Quote a column name that is a reserved word, for the configured SQL driver
+func quoteIdentifier(identifier string) string {
+	if appDBDriver == "mssql" {
+		return "[" + identifier + "]"
+	}
+	return "`" + identifier + "`"
+}
+
 //buildConnectionString -- Build the connection string for the SQL driver
 func buildConnectionString() string {
 	connectString := ""